@@ -2,11 +2,21 @@
 package backend
 
 import (
+	"bytes"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
+	"os"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/docker/libkv"
 	"github.com/docker/libkv/store"
 	"github.com/docker/libkv/store/boltdb"
+	"github.com/docker/libkv/store/consul"
+	"github.com/docker/libkv/store/etcd"
+	"github.com/docker/libkv/store/zookeeper"
 )
 
 const (
@@ -14,10 +24,24 @@ const (
 	credKey        = "creds"
 )
 
+// ErrTLSUnsupported is returned when TLS is asked for on a backend without it
+var ErrTLSUnsupported = errors.New("the key-value store doesn't support TLS")
+
 // StorageContainer is the top-level struct for persistence
 type StorageContainer struct {
-	CredentialURLs []string
-	LastIndex      uint64
+	// MasterKey is the store master key wrapped with the store passphrase,
+	// it is empty until the first credential is stored
+	MasterKey string
+	Entries   []Entry
+	LastIndex uint64
+}
+
+// persistedContainer is the serialized form of a StorageContainer
+type persistedContainer struct {
+	MasterKey string  `json:"master_key,omitempty"`
+	Entries   []Entry `json:"entries"`
+	// Credentials holds the URL form written before entries were typed
+	Credentials []string `json:"credentials,omitempty"`
 }
 
 // CryptStoreInterface defines the persistence interface exposed to other packages
@@ -29,37 +53,149 @@ type CryptStoreInterface interface {
 // CryptStore internally holds all persistence state dependencies
 type CryptStore struct {
 	db store.Store
+	// prefix is put in front of every key, a shared key-value store holds more
+	// than our keys
+	prefix string
+	// cache is only set when the container is kept between reads
+	cache *containerCache
+}
+
+// KVOptions configures the connection to a libkv store. The zero value is a
+// plain connection without a prefix.
+type KVOptions struct {
+	// Prefix is put in front of every key, e.g. team/git
+	Prefix string
+	// TLS enables TLS, ZooKeeper has no support for it
+	TLS *tls.Config
+	// Username and Password authenticate to etcd
+	Username string
+	Password string
+	// ConnectionTimeout overrides the timeout of the backend
+	ConnectionTimeout time.Duration
+	// Watch keeps the container cached between reads and watches the store to
+	// drop it when another process writes
+	Watch bool
+	// Bucket is the bolt bucket, other backends ignore it
+	Bucket string
 }
 
-// OpenCryptStore initializes and opens the persistence file
-func OpenCryptStore(storeLocation string) (*CryptStore, error) {
-	boltdb.Register()
-
-	kv, err := libkv.NewStore(
-		store.BOLTDB,
-		[]string{storeLocation},
-		&store.Config{
-			Bucket: boltBaseString,
-		},
-	)
+// registerKVBackends makes the libkv backends available, libkv keeps them in a
+// map without a lock so this happens once
+var registerKVBackends sync.Once
+
+// OpenCryptStore opens the container kept in a libkv store of the provided kind
+// and migrates it to the current schema. For store.BOLTDB the endpoint is the
+// path of the file.
+func OpenCryptStore(kind store.Backend, endpoints []string, options *KVOptions) (*CryptStore, error) {
+	cs, err := OpenCryptStoreUnmigrated(kind, endpoints, options)
 	if err != nil {
 		return nil, err
 	}
 
-	return &CryptStore{
-		db: kv,
-	}, nil
+	if _, err := cs.Migrate(false); err != nil {
+		cs.Close()
+		return nil, err
+	}
+
+	return cs, nil
+}
+
+// OpenCryptStoreUnmigrated opens the container as it is, so pending migrations
+// can be inspected first
+func OpenCryptStoreUnmigrated(kind store.Backend, endpoints []string, options *KVOptions) (*CryptStore, error) {
+	if options == nil {
+		options = new(KVOptions)
+	}
+
+	registerKVBackends.Do(func() {
+		boltdb.Register()
+		consul.Register()
+		etcd.Register()
+		zookeeper.Register()
+	})
+
+	if options.TLS != nil && kind == store.ZK {
+		return nil, ErrTLSUnsupported
+	}
+
+	config := &store.Config{
+		TLS:               options.TLS,
+		ConnectionTimeout: options.ConnectionTimeout,
+		Bucket:            options.Bucket,
+		Username:          options.Username,
+		Password:          options.Password,
+	}
+	if kind == store.BOLTDB {
+		if config.Bucket == "" {
+			config.Bucket = boltBaseString
+		}
+		// libkv would create the file readable by everyone
+		if err := createBoltFile(endpoints[0]); err != nil {
+			return nil, err
+		}
+	}
+
+	kv, err := libkv.NewStore(kind, endpoints, config)
+	if err != nil {
+		return nil, err
+	}
+	if kind == store.ZK {
+		kv = zooKeeperStore{kv}
+	}
+
+	cs := &CryptStore{
+		db:     kv,
+		prefix: strings.Trim(options.Prefix, "/"),
+	}
+	if options.Watch {
+		cs.cache = new(containerCache)
+	}
+
+	return cs, nil
+}
+
+// createBoltFile creates a missing bolt file for libkv with storeFileMode, an
+// existing one has to pass the permission check
+func createBoltFile(path string) error {
+	if err := prepareBoltFile(path); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(path, os.O_RDONLY|os.O_CREATE, storeFileMode)
+	if err != nil {
+		return err
+	}
+
+	return f.Close()
+}
+
+// Close stops the watch and the connection to the store
+func (cs *CryptStore) Close() {
+	if cs.cache != nil {
+		cs.cache.stop()
+	}
+
+	cs.db.Close()
+}
+
+// key returns the full name of one of our keys
+func (cs *CryptStore) key(name string) string {
+	if cs.prefix == "" {
+		return name
+	}
+
+	return cs.prefix + "/" + name
 }
 
 // GetStorageContainer returns the entire storage container
 func (cs *CryptStore) GetStorageContainer() (*StorageContainer, error) {
 	s := new(StorageContainer)
 
-	pair, err := cs.db.Get(credKey)
+	pair, err := cs.getContainer()
 	if err != nil {
 		if err == store.ErrKeyNotFound {
 			// initialize an empty object
-			s.CredentialURLs = make([]string, 0)
+			s.Entries = make([]Entry, 0)
 			s.LastIndex = 0
 
 			return s, nil
@@ -68,12 +204,13 @@ func (cs *CryptStore) GetStorageContainer() (*StorageContainer, error) {
 		return nil, err
 	}
 
-	var ret []string
-	if err := json.Unmarshal(pair.Value, &ret); err != nil {
+	ret, _, err := decodeContainer(pair.Value)
+	if err != nil {
 		return nil, err
 	}
 
-	s.CredentialURLs = ret
+	s.MasterKey = ret.MasterKey
+	s.Entries = ret.Entries
 	s.LastIndex = pair.LastIndex
 
 	return s, nil
@@ -90,15 +227,66 @@ func (cs *CryptStore) PersistStorageContainer(s *StorageContainer) error {
 		}
 	}
 
-	data, err := json.Marshal(s.CredentialURLs)
+	data, err := json.Marshal(&persistedContainer{
+		MasterKey: s.MasterKey,
+		Entries:   s.Entries,
+	})
 	if err != nil {
 		return err
 	}
 
-	_, _, err = cs.db.AtomicPut(credKey, data, previous, nil)
+	_, pair, err := cs.db.AtomicPut(cs.key(credKey), data, previous, nil)
+	if err == store.ErrKeyExists {
+		// someone else stored the first container, the same as any other write
+		err = store.ErrKeyModified
+	}
 	if err != nil {
+		if cs.cache != nil {
+			// whatever we hold is out of date, read it again next time
+			cs.cache.invalidate()
+		}
+
 		return err
 	}
 
+	if pair != nil {
+		s.LastIndex = pair.LastIndex
+		cs.cacheContainer(pair)
+	}
+
 	return nil
 }
+
+// decodeContainer reads every container format we ever wrote. It reports
+// whether the credentials had to be converted from the URL form.
+func decodeContainer(value []byte) (persistedContainer, bool, error) {
+	var ret persistedContainer
+	// stores written before the master key only hold the list of credentials
+	if bytes.HasPrefix(bytes.TrimSpace(value), []byte("[")) {
+		if err := json.Unmarshal(value, &ret.Credentials); err != nil {
+			return ret, false, err
+		}
+	} else if err := json.Unmarshal(value, &ret); err != nil {
+		return ret, false, err
+	}
+
+	if ret.Entries == nil {
+		ret.Entries = make([]Entry, 0, len(ret.Credentials))
+	}
+
+	if ret.Credentials == nil {
+		return ret, false, nil
+	}
+
+	for _, rawurl := range ret.Credentials {
+		e, err := EntryFromURL(rawurl)
+		if err != nil {
+			return ret, false, err
+		}
+
+		ret.Entries = append(ret.Entries, e)
+	}
+	ret.Credentials = nil
+
+	return ret, true, nil
+}
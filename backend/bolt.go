@@ -0,0 +1,541 @@
+package backend
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/docker/libkv/store"
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	// entriesBucket holds a bucket per host with a key per entry
+	entriesBucket = "entries"
+	// metaBucket holds the master key, generation and schema version
+	metaBucket = "meta"
+
+	masterKeyKey  = "master_key"
+	generationKey = "generation"
+	// noHostBucket holds the entries without a host, bolt needs a bucket name
+	noHostBucket = "\x00"
+	// libkvMetadataLen is the index libkv puts in front of every value
+	libkvMetadataLen = 8
+	// nativeSchemaVersion is the first schema stored one key per entry
+	nativeSchemaVersion = 1
+	// boltTimeout is how long we wait for another process to release the file
+	boltTimeout = 10 * time.Second
+)
+
+// BoltStore persists every entry under its own key, in a bucket per host. Every
+// call opens the file in its own transaction, so concurrent git processes
+// take turns rather than fail. As a HostStore it reads and writes the buckets
+// of a single host, the whole container is only needed by commands about the
+// whole store.
+type BoltStore struct {
+	path string
+}
+
+// OpenBoltStore opens the bolt file and brings it to the current schema. Stores
+// written through libkv are converted to one key per entry.
+func OpenBoltStore(storeLocation string) (*BoltStore, error) {
+	bs, err := OpenBoltStoreUnmigrated(storeLocation)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := bs.Migrate(false); err != nil {
+		return nil, err
+	}
+
+	return bs, nil
+}
+
+// OpenBoltStoreUnmigrated opens the bolt file as it is, so pending migrations
+// can be inspected first
+func OpenBoltStoreUnmigrated(storeLocation string) (*BoltStore, error) {
+	if err := prepareBoltFile(storeLocation); err != nil {
+		return nil, err
+	}
+
+	bs := &BoltStore{path: storeLocation}
+	// make sure the file can be opened at all before anything else happens
+	return bs, bs.view(func(tx *bolt.Tx) error { return nil })
+}
+
+// GetStorageContainer reads every entry, in the order they were stored
+func (bs *BoltStore) GetStorageContainer() (*StorageContainer, error) {
+	return bs.get(nil)
+}
+
+// get reads the entries in the buckets of hosts, or every entry when hosts is nil
+func (bs *BoltStore) get(hosts [][]byte) (*StorageContainer, error) {
+	s := &StorageContainer{
+		Entries: make([]Entry, 0),
+	}
+
+	err := bs.view(func(tx *bolt.Tx) error {
+		if meta := tx.Bucket([]byte(metaBucket)); meta != nil {
+			s.MasterKey = string(meta.Get([]byte(masterKeyKey)))
+			s.LastIndex = decodeUint64(meta.Get([]byte(generationKey)))
+		}
+
+		var err error
+		s.Entries, err = readEntries(tx, hosts)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// GetHostContainer reads the entries of host and those without a host only
+func (bs *BoltStore) GetHostContainer(host string) (*StorageContainer, error) {
+	return bs.get(hostBuckets(host))
+}
+
+// hostBuckets names the buckets holding the entries a request for host can
+// match, entries without a host match any
+func hostBuckets(host string) [][]byte {
+	return [][]byte{hostBucketName(host), []byte(noHostBucket)}
+}
+
+// readEntries decodes the entries in the buckets of hosts, or every entry when
+// hosts is nil, in the order they were stored
+func readEntries(tx *bolt.Tx, hosts [][]byte) ([]Entry, error) {
+	ret := make([]Entry, 0)
+
+	entries := tx.Bucket([]byte(entriesBucket))
+	if entries == nil {
+		return ret, nil
+	}
+
+	err := forEachEntry(entries, hosts, func(_ []byte, id []byte, value []byte) error {
+		var e Entry
+		if err := json.Unmarshal(value, &e); err != nil {
+			return err
+		}
+
+		e.ID = decodeUint64(id)
+		ret = append(ret, e)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(ret, func(i, j int) bool { return ret[i].ID < ret[j].ID })
+
+	return ret, nil
+}
+
+// PersistStorageContainer writes the entries that changed and deletes the ones
+// that are gone, in a single transaction. It fails with store.ErrKeyModified
+// when another process persisted since s was read.
+func (bs *BoltStore) PersistStorageContainer(s *StorageContainer) error {
+	return bs.persist(s, nil)
+}
+
+// PersistHostContainer persists a container read by GetHostContainer, entries
+// of other hosts are left alone
+func (bs *BoltStore) PersistHostContainer(host string, s *StorageContainer) error {
+	return bs.persist(s, hostBuckets(host))
+}
+
+// persist writes s, which holds the entries of the buckets of hosts or every
+// entry when hosts is nil
+func (bs *BoltStore) persist(s *StorageContainer, hosts [][]byte) error {
+	// new entries get their ID in the transaction, take it back if that fails
+	var assigned []int
+	var generation uint64
+
+	err := bs.update(func(tx *bolt.Tx) error {
+		meta, err := tx.CreateBucketIfNotExists([]byte(metaBucket))
+		if err != nil {
+			return err
+		}
+
+		generation = decodeUint64(meta.Get([]byte(generationKey)))
+		if generation != s.LastIndex {
+			return store.ErrKeyModified
+		}
+
+		entries, err := tx.CreateBucketIfNotExists([]byte(entriesBucket))
+		if err != nil {
+			return err
+		}
+		// remember where every stored entry lives to find the ones that are gone
+		stale := make(map[uint64][]byte)
+		err = forEachEntry(entries, hosts, func(host []byte, id []byte, _ []byte) error {
+			stale[decodeUint64(id)] = append([]byte{}, host...)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for idx := range s.Entries {
+			e := &s.Entries[idx]
+			if e.ID == 0 {
+				if e.ID, err = entries.NextSequence(); err != nil {
+					return err
+				}
+				assigned = append(assigned, idx)
+			}
+
+			host := hostBucketName(e.Host)
+			if previous, ok := stale[e.ID]; ok && !bytes.Equal(previous, host) {
+				// the entry moved to another host, drop the old key
+				if err := deleteEntry(entries, previous, e.ID); err != nil {
+					return err
+				}
+			}
+			delete(stale, e.ID)
+
+			if err := putEntry(entries, host, e); err != nil {
+				return err
+			}
+		}
+
+		for id, host := range stale {
+			if err := deleteEntry(entries, host, id); err != nil {
+				return err
+			}
+		}
+
+		if err := meta.Put([]byte(masterKeyKey), []byte(s.MasterKey)); err != nil {
+			return err
+		}
+
+		return meta.Put([]byte(generationKey), encodeUint64(generation+1))
+	})
+	if err != nil {
+		for _, idx := range assigned {
+			s.Entries[idx].ID = 0
+		}
+
+		return err
+	}
+
+	s.LastIndex = generation + 1
+	return nil
+}
+
+// Migrate brings the file up to CurrentSchemaVersion. A container written
+// through libkv is migrated as usual and then split into one key per entry, the
+// libkv bucket itself is left as it was as a backup. A native store runs its
+// pending migrations in the same transaction that records the new schema and
+// a backup. With dryRun set nothing is written, the returned steps are the
+// ones that would run.
+func (bs *BoltStore) Migrate(dryRun bool) ([]MigrationStep, error) {
+	var steps []MigrationStep
+
+	update := bs.update
+	if dryRun {
+		update = bs.view
+	}
+
+	err := update(func(tx *bolt.Tx) error {
+		steps = nil
+
+		if meta := tx.Bucket([]byte(metaBucket)); meta != nil {
+			version, err := strconv.Atoi(string(meta.Get([]byte(schemaKey))))
+			if err != nil {
+				return err
+			}
+
+			if version > CurrentSchemaVersion {
+				return ErrSchemaTooNew
+			}
+			if version < nativeSchemaVersion {
+				return fmt.Errorf("migration failure: a bolt store can't be on schema %d", version)
+			}
+
+			steps = pendingMigrations(version)
+			if len(steps) == 0 || dryRun {
+				return nil
+			}
+
+			return migrateNative(tx, meta, version)
+		}
+
+		version, value, err := readLibkvContainer(tx)
+		if err != nil || value == nil {
+			if err == nil && !dryRun {
+				// a new store starts out on the current schema
+				return initMeta(tx, 0)
+			}
+
+			return err
+		}
+
+		steps = append(pendingMigrations(version), MigrationStep{
+			From:        CurrentSchemaVersion,
+			To:          CurrentSchemaVersion,
+			Description: "store every credential under its own key",
+		})
+		if dryRun {
+			return nil
+		}
+
+		value, err = applyMigrations(value, version)
+		if err != nil {
+			return err
+		}
+
+		ret, _, err := decodeContainer(value)
+		if err != nil {
+			return err
+		}
+
+		return writeConverted(tx, ret)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return steps, nil
+}
+
+// readLibkvContainer returns the container written through libkv and its schema
+// version, the value is nil when there is none
+func readLibkvContainer(tx *bolt.Tx) (int, []byte, error) {
+	bucket := tx.Bucket([]byte(boltBaseString))
+	if bucket == nil {
+		return 0, nil, nil
+	}
+
+	value := bucket.Get([]byte(credKey))
+	if len(value) < libkvMetadataLen {
+		return 0, nil, nil
+	}
+
+	version := 0
+	if schema := bucket.Get([]byte(schemaKey)); len(schema) > libkvMetadataLen {
+		var err error
+		version, err = strconv.Atoi(string(schema[libkvMetadataLen:]))
+		if err != nil {
+			return 0, nil, err
+		}
+	}
+
+	return version, append([]byte{}, value[libkvMetadataLen:]...), nil
+}
+
+// writeConverted stores a migrated libkv container in the native layout
+func writeConverted(tx *bolt.Tx, ret persistedContainer) error {
+	if err := writeEntries(tx, ret.Entries); err != nil {
+		return err
+	}
+
+	if err := initMeta(tx, 1); err != nil {
+		return err
+	}
+
+	return tx.Bucket([]byte(metaBucket)).Put([]byte(masterKeyKey), []byte(ret.MasterKey))
+}
+
+// migrateNative runs the pending migrations on the container held in the
+// native layout. The container as it was is kept in the meta bucket under a
+// backup key, and the generation is bumped so writers that read it before fail.
+func migrateNative(tx *bolt.Tx, meta *bolt.Bucket, version int) error {
+	entries, err := readEntries(tx, nil)
+	if err != nil {
+		return err
+	}
+
+	value, err := json.Marshal(&persistedContainer{
+		MasterKey: string(meta.Get([]byte(masterKeyKey))),
+		Entries:   entries,
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := meta.Put([]byte(backupKeyPrefix+strconv.Itoa(version)), value); err != nil {
+		return err
+	}
+
+	value, err = applyMigrations(value, version)
+	if err != nil {
+		return err
+	}
+
+	ret, _, err := decodeContainer(value)
+	if err != nil {
+		return err
+	}
+
+	// the entries are written again from scratch, in their order
+	if tx.Bucket([]byte(entriesBucket)) != nil {
+		if err := tx.DeleteBucket([]byte(entriesBucket)); err != nil {
+			return err
+		}
+	}
+	if err := writeEntries(tx, ret.Entries); err != nil {
+		return err
+	}
+
+	if err := meta.Put([]byte(masterKeyKey), []byte(ret.MasterKey)); err != nil {
+		return err
+	}
+
+	if err := meta.Put([]byte(schemaKey), []byte(strconv.Itoa(CurrentSchemaVersion))); err != nil {
+		return err
+	}
+
+	generation := decodeUint64(meta.Get([]byte(generationKey)))
+	return meta.Put([]byte(generationKey), encodeUint64(generation+1))
+}
+
+// writeEntries creates the entries bucket holding entries with new IDs
+func writeEntries(tx *bolt.Tx, ret []Entry) error {
+	entries, err := tx.CreateBucket([]byte(entriesBucket))
+	if err != nil {
+		return err
+	}
+
+	for idx := range ret {
+		e := &ret[idx]
+		if e.ID, err = entries.NextSequence(); err != nil {
+			return err
+		}
+
+		if err := putEntry(entries, hostBucketName(e.Host), e); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// initMeta creates the meta bucket of a native store
+func initMeta(tx *bolt.Tx, generation uint64) error {
+	meta, err := tx.CreateBucket([]byte(metaBucket))
+	if err != nil {
+		return err
+	}
+
+	if err := meta.Put([]byte(schemaKey), []byte(strconv.Itoa(CurrentSchemaVersion))); err != nil {
+		return err
+	}
+
+	return meta.Put([]byte(generationKey), encodeUint64(generation))
+}
+
+// putEntry writes e unless the stored value is the same already
+func putEntry(entries *bolt.Bucket, host []byte, e *Entry) error {
+	bucket, err := entries.CreateBucketIfNotExists(host)
+	if err != nil {
+		return err
+	}
+
+	value, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	id := encodeUint64(e.ID)
+	if bytes.Equal(bucket.Get(id), value) {
+		return nil
+	}
+
+	return bucket.Put(id, value)
+}
+
+// forEachEntry calls fn for every entry in the buckets of hosts, or in every
+// bucket when hosts is nil
+func forEachEntry(entries *bolt.Bucket, hosts [][]byte, fn func(host []byte, id []byte, value []byte) error) error {
+	inHost := func(host []byte) error {
+		bucket := entries.Bucket(host)
+		if bucket == nil {
+			return nil
+		}
+
+		return bucket.ForEach(func(id []byte, value []byte) error {
+			return fn(host, id, value)
+		})
+	}
+
+	if hosts == nil {
+		return entries.ForEach(func(host []byte, _ []byte) error {
+			return inHost(host)
+		})
+	}
+
+	for _, host := range hosts {
+		if err := inHost(host); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// deleteEntry removes an entry and its host bucket once that is empty
+func deleteEntry(entries *bolt.Bucket, host []byte, id uint64) error {
+	bucket := entries.Bucket(host)
+	if bucket == nil {
+		return nil
+	}
+
+	if err := bucket.Delete(encodeUint64(id)); err != nil {
+		return err
+	}
+
+	if k, _ := bucket.Cursor().First(); k == nil {
+		return entries.DeleteBucket(host)
+	}
+
+	return nil
+}
+
+func hostBucketName(host string) []byte {
+	if host == "" {
+		return []byte(noHostBucket)
+	}
+
+	return []byte(host)
+}
+
+func (bs *BoltStore) view(fn func(tx *bolt.Tx) error) error {
+	db, err := bolt.Open(bs.path, storeFileMode, &bolt.Options{Timeout: boltTimeout})
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	return db.View(fn)
+}
+
+func (bs *BoltStore) update(fn func(tx *bolt.Tx) error) error {
+	db, err := bolt.Open(bs.path, storeFileMode, &bolt.Options{Timeout: boltTimeout})
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	return db.Update(fn)
+}
+
+// encodeUint64 keeps keys in numeric order
+func encodeUint64(v uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, v)
+
+	return b
+}
+
+func decodeUint64(b []byte) uint64 {
+	if len(b) != 8 {
+		return 0
+	}
+
+	return binary.BigEndian.Uint64(b)
+}
@@ -0,0 +1,397 @@
+package backend
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/docker/libkv/store"
+)
+
+// conformanceBackend creates an empty store for every test. Every call of open
+// returns a new handle on that store, the way separate git processes get one.
+type conformanceBackend struct {
+	name   string
+	create func(t *testing.T) (open func() (CryptStoreInterface, error), cleanup func())
+	// file and openFile are set for backends keeping the store in a local
+	// file, openFile opens the store at a path
+	file     string
+	openFile func(path string) (CryptStoreInterface, error)
+}
+
+// conformanceBackends lists every CryptStoreInterface implementation, a new
+// backend is added here to run it through the suite
+var conformanceBackends = []conformanceBackend{
+	{
+		name: "memory",
+		create: func(t *testing.T) (func() (CryptStoreInterface, error), func()) {
+			ms := NewMemoryStore()
+			return func() (CryptStoreInterface, error) {
+				return ms, nil
+			}, func() {}
+		},
+	},
+	fileBackend("bolt", "store.db", func(path string) (CryptStoreInterface, error) {
+		return OpenBoltStore(path)
+	}),
+	fileBackend("libkv-bolt", "store.db", func(path string) (CryptStoreInterface, error) {
+		return OpenCryptStore(store.BOLTDB, []string{path}, nil)
+	}),
+	fileBackend("json", "store.json", func(path string) (CryptStoreInterface, error) {
+		return OpenFileStore(path)
+	}),
+	fileBackend("toml", "store.toml", func(path string) (CryptStoreInterface, error) {
+		return OpenFileStore(path)
+	}),
+	{
+		name: "consul",
+		create: kvBackend("/team", func(t *testing.T) (string, func()) {
+			_, location, stop := startConsul(t)
+			return location, stop
+		}),
+	},
+	{
+		name: "consul-watch",
+		create: kvBackend("/team?watch=true", func(t *testing.T) (string, func()) {
+			_, location, stop := startConsul(t)
+			return location, stop
+		}),
+	},
+	{
+		name: "etcd",
+		create: kvBackend("/team", func(t *testing.T) (string, func()) {
+			_, location, stop := startEtcd(t)
+			return location, stop
+		}),
+	},
+	{
+		name: "etcd-watch",
+		create: kvBackend("/team?watch=true", func(t *testing.T) (string, func()) {
+			_, location, stop := startEtcd(t)
+			return location, stop
+		}),
+	},
+	{
+		name: "zk",
+		create: kvBackend("/team", func(t *testing.T) (string, func()) {
+			_, location, stop := startZooKeeper(t)
+			return location, stop
+		}),
+	},
+	{
+		name: "zk-watch",
+		create: kvBackend("/team?watch=true", func(t *testing.T) (string, func()) {
+			_, location, stop := startZooKeeper(t)
+			return location, stop
+		}),
+	},
+}
+
+// kvBackend runs a fake key-value store for every test and opens the location
+// below it, every handle is closed before the fake stops
+func kvBackend(location string, start func(t *testing.T) (string, func())) func(t *testing.T) (func() (CryptStoreInterface, error), func()) {
+	return func(t *testing.T) (func() (CryptStoreInterface, error), func()) {
+		prefix, stop := start(t)
+		var handles []*CryptStore
+		var mu sync.Mutex
+
+		return func() (CryptStoreInterface, error) {
+				cs, err := Open(prefix + location)
+				if err == nil {
+					mu.Lock()
+					handles = append(handles, cs.(*CryptStore))
+					mu.Unlock()
+				}
+				return cs, err
+			}, func() {
+				for _, cs := range handles {
+					cs.Close()
+				}
+				stop()
+			}
+	}
+}
+
+// fileBackend keeps the store in the file name of a new temporary directory
+func fileBackend(name, file string, open func(path string) (CryptStoreInterface, error)) conformanceBackend {
+	return conformanceBackend{
+		name: name,
+		create: func(t *testing.T) (func() (CryptStoreInterface, error), func()) {
+			path, cleanup := tempStorePath(t, file)
+			return func() (CryptStoreInterface, error) {
+				return open(path)
+			}, cleanup
+		},
+		file:     file,
+		openFile: open,
+	}
+}
+
+// tempStorePath returns the path of a store file in a new temporary directory
+// and a function removing that directory
+func tempStorePath(t *testing.T, name string) (string, func()) {
+	dir, err := ioutil.TempDir("", "store")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return filepath.Join(dir, name), func() { os.RemoveAll(dir) }
+}
+
+func TestConformance(t *testing.T) {
+	tests := []struct {
+		name string
+		run  func(t *testing.T, open func() (CryptStoreInterface, error))
+	}{
+		{"EmptyContainer", testEmptyContainer},
+		{"RoundTrip", testRoundTrip},
+		{"StaleLastIndex", testStaleLastIndex},
+		{"ConcurrentCreate", testConcurrentCreate},
+		{"ConcurrentWriters", testConcurrentWriters},
+		{"ConcurrentUpdates", testConcurrentUpdates},
+	}
+
+	for _, backend := range conformanceBackends {
+		backend := backend
+		t.Run(backend.name, func(t *testing.T) {
+			for _, test := range tests {
+				test := test
+				t.Run(test.name, func(t *testing.T) {
+					open, cleanup := backend.create(t)
+					defer cleanup()
+
+					test.run(t, open)
+				})
+			}
+		})
+	}
+}
+
+// mustOpen opens a handle on the store under test
+func mustOpen(t *testing.T, open func() (CryptStoreInterface, error)) CryptStoreInterface {
+	cs, err := open()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return cs
+}
+
+func mustGet(t *testing.T, cs CryptStoreInterface) *StorageContainer {
+	s, err := cs.GetStorageContainer()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return s
+}
+
+func testEmptyContainer(t *testing.T, open func() (CryptStoreInterface, error)) {
+	s := mustGet(t, mustOpen(t, open))
+
+	if s.Entries == nil {
+		t.Fatal("a new store returns nil entries instead of an empty list")
+	}
+	if len(s.Entries) != 0 || s.MasterKey != "" || s.LastIndex != 0 {
+		t.Fatalf("a new store holds %+v", s)
+	}
+}
+
+func testRoundTrip(t *testing.T, open func() (CryptStoreInterface, error)) {
+	cs := mustOpen(t, open)
+	s := mustGet(t, cs)
+
+	used := time.Date(2021, 3, 4, 5, 6, 7, 0, time.UTC)
+	full := Entry{
+		Protocol:          "https",
+		Host:              "example.com",
+		Path:              "org/repo.git",
+		Username:          "alice",
+		Password:          "ciphertext",
+		AuthType:          "Bearer",
+		Credential:        "credential ciphertext",
+		PasswordExpiryUTC: "1700000000",
+		OAuthRefreshToken: "refresh ciphertext",
+		SecretHash:        "hash",
+		RefreshTokenHash:  "refresh hash",
+		CreatedAt:         &used,
+		UpdatedAt:         &used,
+		LastUsedAt:        &used,
+		UseCount:          3,
+	}
+	s.MasterKey = "wrapped master key"
+	s.Entries = append(s.Entries, full, testEntry("", "nohost"), testEntry("example.org", "bob"))
+
+	if err := cs.PersistStorageContainer(s); err != nil {
+		t.Fatal(err)
+	}
+	if s.LastIndex == 0 {
+		t.Fatal("persisting left LastIndex at 0")
+	}
+
+	got := mustGet(t, mustOpen(t, open))
+	if got.MasterKey != s.MasterKey || got.LastIndex != s.LastIndex {
+		t.Fatalf("read back master key %q at %d, persisted %q at %d", got.MasterKey, got.LastIndex, s.MasterKey, s.LastIndex)
+	}
+	if !reflect.DeepEqual(got.Entries, s.Entries) {
+		t.Fatalf("read back %+v, persisted %+v", got.Entries, s.Entries)
+	}
+
+	// entries that are gone are removed, the others are kept in order
+	got.Entries = append(got.Entries[:1], got.Entries[2:]...)
+	got.Entries[0].UseCount++
+	if err := cs.PersistStorageContainer(got); err != nil {
+		t.Fatal(err)
+	}
+
+	again := mustGet(t, cs)
+	if !reflect.DeepEqual(again.Entries, got.Entries) {
+		t.Fatalf("read back %+v after removing an entry, persisted %+v", again.Entries, got.Entries)
+	}
+}
+
+func testStaleLastIndex(t *testing.T, open func() (CryptStoreInterface, error)) {
+	first := mustOpen(t, open)
+	second := mustOpen(t, open)
+
+	s := mustGet(t, first)
+	s.Entries = append(s.Entries, testEntry("example.com", "alice"))
+	if err := first.PersistStorageContainer(s); err != nil {
+		t.Fatal(err)
+	}
+
+	stale := mustGet(t, second)
+	current := mustGet(t, first)
+	current.Entries = append(current.Entries, testEntry("example.org", "bob"))
+	if err := first.PersistStorageContainer(current); err != nil {
+		t.Fatal(err)
+	}
+
+	stale.Entries = append(stale.Entries, testEntry("example.net", "carol"))
+	if err := second.PersistStorageContainer(stale); err != store.ErrKeyModified {
+		t.Fatalf("persisting at a stale LastIndex gave %v", err)
+	}
+
+	got := mustGet(t, second)
+	if len(got.Entries) != 2 || got.Entries[1].Username != "bob" {
+		t.Fatalf("the stale write changed the store to %+v", got.Entries)
+	}
+}
+
+func testConcurrentCreate(t *testing.T, open func() (CryptStoreInterface, error)) {
+	first := mustOpen(t, open)
+	second := mustOpen(t, open)
+
+	a := mustGet(t, first)
+	b := mustGet(t, second)
+
+	a.Entries = append(a.Entries, testEntry("example.com", "alice"))
+	if err := first.PersistStorageContainer(a); err != nil {
+		t.Fatal(err)
+	}
+
+	b.Entries = append(b.Entries, testEntry("example.org", "bob"))
+	if err := second.PersistStorageContainer(b); err != store.ErrKeyModified {
+		t.Fatalf("creating the container twice gave %v", err)
+	}
+}
+
+func testConcurrentWriters(t *testing.T, open func() (CryptStoreInterface, error)) {
+	const writers = 8
+
+	var wg sync.WaitGroup
+	errs := make(chan error, writers)
+
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			cs, err := open()
+			if err != nil {
+				errs <- err
+				return
+			}
+
+			for {
+				s, err := cs.GetStorageContainer()
+				if err != nil {
+					errs <- err
+					return
+				}
+
+				s.Entries = append(s.Entries, testEntry("example.com", fmt.Sprintf("writer%d", i)))
+				err = cs.PersistStorageContainer(s)
+				if err == store.ErrKeyModified {
+					continue
+				}
+				if err != nil {
+					errs <- err
+				}
+				return
+			}
+		}(i)
+	}
+
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+
+	got := mustGet(t, mustOpen(t, open))
+	if len(got.Entries) != writers {
+		t.Fatalf("%d writers left %d entries", writers, len(got.Entries))
+	}
+
+	seen := make(map[string]bool)
+	for _, e := range got.Entries {
+		seen[e.Username] = true
+	}
+	if len(seen) != writers {
+		t.Fatalf("writes were lost, the store holds %+v", got.Entries)
+	}
+}
+
+func testConcurrentUpdates(t *testing.T, open func() (CryptStoreInterface, error)) {
+	const writers = 8
+
+	var wg sync.WaitGroup
+	errs := make(chan error, writers)
+
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			cs, err := open()
+			if err != nil {
+				errs <- err
+				return
+			}
+
+			errs <- Update(cs, func(s *StorageContainer) (bool, error) {
+				s.Entries = append(s.Entries, testEntry("example.com", fmt.Sprintf("writer%d", i)))
+				return true, nil
+			})
+		}(i)
+	}
+
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	got := mustGet(t, mustOpen(t, open))
+	if len(got.Entries) != writers {
+		t.Fatalf("%d writers left %d entries", writers, len(got.Entries))
+	}
+}
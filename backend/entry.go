@@ -0,0 +1,89 @@
+package backend
+
+import (
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Entry is a stored credential. Password, Credential and OAuthRefreshToken hold
+// ciphertexts, everything else is kept as git sent it.
+type Entry struct {
+	// ID identifies the entry in backends that store entries one by one, it is
+	// zero for entries that were never persisted
+	ID       uint64 `json:"-" toml:"-"`
+	Protocol string `json:"protocol" toml:"protocol"`
+	Host     string `json:"host,omitempty" toml:"host,omitempty"`
+	Path     string `json:"path,omitempty" toml:"path,omitempty"`
+	Username string `json:"username,omitempty" toml:"username,omitempty"`
+	Password string `json:"password,omitempty" toml:"password,omitempty"`
+	// AuthType and Credential replace username and password for schemes such as Bearer
+	AuthType          string `json:"authtype,omitempty" toml:"authtype,omitempty"`
+	Credential        string `json:"credential,omitempty" toml:"credential,omitempty"`
+	PasswordExpiryUTC string `json:"password_expiry_utc,omitempty" toml:"password_expiry_utc,omitempty"`
+	OAuthRefreshToken string `json:"oauth_refresh_token,omitempty" toml:"oauth_refresh_token,omitempty"`
+	// SecretHash and RefreshTokenHash compare secrets without decrypting them
+	SecretHash       string `json:"secret_hash,omitempty" toml:"secret_hash,omitempty"`
+	RefreshTokenHash string `json:"refresh_token_hash,omitempty" toml:"refresh_token_hash,omitempty"`
+	// the usage metadata is missing for credentials stored by older versions
+	CreatedAt  *time.Time `json:"created_at,omitempty" toml:"created_at,omitempty"`
+	UpdatedAt  *time.Time `json:"updated_at,omitempty" toml:"updated_at,omitempty"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty" toml:"last_used_at,omitempty"`
+	UseCount   uint64     `json:"use_count,omitempty" toml:"use_count,omitempty"`
+}
+
+// EntryFromURL parses a credential written by older versions as a URL, with the
+// ciphertext as the password and any other attribute in the query
+func EntryFromURL(rawurl string) (Entry, error) {
+	var e Entry
+
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return e, err
+	}
+
+	e.Protocol = u.Scheme
+	e.Host = u.Host
+	// git sends the path without its leading slash, the URL form added it
+	e.Path = u.Path
+	if e.Host != "" {
+		e.Path = strings.TrimPrefix(e.Path, "/")
+	}
+	if u.User != nil {
+		e.Username = u.User.Username()
+		e.Password, _ = u.User.Password()
+	}
+
+	query := u.Query()
+	e.AuthType = query.Get("authtype")
+	e.Credential = query.Get("credential")
+	e.PasswordExpiryUTC = query.Get("password_expiry_utc")
+	e.OAuthRefreshToken = query.Get("oauth_refresh_token")
+	e.SecretHash = query.Get("secret_hash")
+	e.RefreshTokenHash = query.Get("refresh_token_hash")
+
+	for key, t := range map[string]**time.Time{
+		"created_at":   &e.CreatedAt,
+		"updated_at":   &e.UpdatedAt,
+		"last_used_at": &e.LastUsedAt,
+	} {
+		if value := query.Get(key); value != "" {
+			parsed, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				return e, err
+			}
+
+			*t = &parsed
+		}
+	}
+
+	if useCount := query.Get("use_count"); useCount != "" {
+		e.UseCount, err = strconv.ParseUint(useCount, 10, 64)
+		if err != nil {
+			return e, err
+		}
+	}
+
+	return e, nil
+}
@@ -0,0 +1,245 @@
+package backend
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/coreos/etcd/client"
+)
+
+// fakeEtcd serves the part of the etcd v2 keys API libkv uses: reads, writes
+// with prevExist and prevIndex, long polling watches and the member list the
+// client syncs its endpoints from
+type fakeEtcd struct {
+	mu      sync.Mutex
+	index   uint64
+	nodes   map[string]*client.Node
+	changed chan struct{}
+	// username and password are required from every request when set
+	username string
+	password string
+}
+
+func newFakeEtcd() *fakeEtcd {
+	return &fakeEtcd{
+		index:   1,
+		nodes:   make(map[string]*client.Node),
+		changed: make(chan struct{}),
+	}
+}
+
+func (f *fakeEtcd) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if f.username != "" {
+		username, password, ok := r.BasicAuth()
+		if !ok || username != f.username || password != f.password {
+			f.mu.Lock()
+			f.fail(w, http.StatusUnauthorized, client.ErrorCodeUnauthorized, "The request requires user authentication", "")
+			f.mu.Unlock()
+			return
+		}
+	}
+
+	if r.URL.Path == "/v2/members" {
+		f.members(w, r)
+		return
+	}
+	if !strings.HasPrefix(r.URL.Path, "/v2/keys/") {
+		http.NotFound(w, r)
+		return
+	}
+	key := strings.TrimPrefix(r.URL.Path, "/v2/keys")
+
+	switch r.Method {
+	case http.MethodGet:
+		if r.URL.Query().Get("wait") == "true" {
+			f.wait(w, r, key)
+			return
+		}
+
+		f.mu.Lock()
+		defer f.mu.Unlock()
+
+		node, ok := f.nodes[key]
+		if !ok {
+			f.fail(w, http.StatusNotFound, client.ErrorCodeKeyNotFound, "Key not found", key)
+			return
+		}
+		f.respond(w, http.StatusOK, &client.Response{Action: "get", Node: node})
+	case http.MethodPut:
+		f.set(w, r, key)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// members lists the fake as the only member, so syncing keeps the endpoint
+func (f *fakeEtcd) members(w http.ResponseWriter, r *http.Request) {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+
+	json.NewEncoder(w).Encode(map[string][]client.Member{
+		"members": {{ID: "1", Name: "fake", ClientURLs: []string{scheme + "://" + r.Host}}},
+	})
+}
+
+func (f *fakeEtcd) set(w http.ResponseWriter, r *http.Request, key string) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	query := r.URL.Query()
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	current, exists := f.nodes[key]
+	switch query.Get("prevExist") {
+	case "false":
+		if exists {
+			f.fail(w, http.StatusPreconditionFailed, client.ErrorCodeNodeExist, "Key already exists", key)
+			return
+		}
+	case "true":
+		if !exists {
+			f.fail(w, http.StatusNotFound, client.ErrorCodeKeyNotFound, "Key not found", key)
+			return
+		}
+	}
+
+	if prevIndex := query.Get("prevIndex"); prevIndex != "" {
+		index, err := strconv.ParseUint(prevIndex, 10, 64)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if !exists {
+			f.fail(w, http.StatusNotFound, client.ErrorCodeKeyNotFound, "Key not found", key)
+			return
+		}
+		if current.ModifiedIndex != index {
+			f.fail(w, http.StatusPreconditionFailed, client.ErrorCodeTestFailed, "Compare failed", key)
+			return
+		}
+	}
+
+	f.bump()
+	node := &client.Node{Key: key, Value: r.PostForm.Get("value"), ModifiedIndex: f.index, CreatedIndex: f.index}
+	status := http.StatusCreated
+	if exists {
+		node.CreatedIndex = current.CreatedIndex
+		status = http.StatusOK
+	}
+	f.nodes[key] = node
+
+	f.respond(w, status, &client.Response{Action: "set", Node: node, PrevNode: current})
+}
+
+// wait answers a watch with the first write of key at or after the wait
+// index. A watch that sees none within maxWait gets an empty answer, which
+// the client takes as a hint to ask again.
+func (f *fakeEtcd) wait(w http.ResponseWriter, r *http.Request, key string) {
+	waitIndex, _ := strconv.ParseUint(r.URL.Query().Get("waitIndex"), 10, 64)
+	deadline := time.After(maxWait)
+
+	f.mu.Lock()
+	if waitIndex == 0 {
+		waitIndex = f.index + 1
+	}
+	for {
+		if node, ok := f.nodes[key]; ok && node.ModifiedIndex >= waitIndex {
+			f.respond(w, http.StatusOK, &client.Response{Action: "set", Node: node})
+			f.mu.Unlock()
+			return
+		}
+
+		changed := f.changed
+		f.mu.Unlock()
+
+		select {
+		case <-changed:
+		case <-deadline:
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+
+		f.mu.Lock()
+	}
+}
+
+// respond writes a keys API answer, the caller holds the lock
+func (f *fakeEtcd) respond(w http.ResponseWriter, status int, resp *client.Response) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Etcd-Index", strconv.FormatUint(f.index, 10))
+	w.WriteHeader(status)
+
+	json.NewEncoder(w).Encode(resp)
+}
+
+// fail writes an etcd error, the caller holds the lock
+func (f *fakeEtcd) fail(w http.ResponseWriter, status int, code int, message, cause string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Etcd-Index", strconv.FormatUint(f.index, 10))
+	w.WriteHeader(status)
+
+	json.NewEncoder(w).Encode(client.Error{Code: code, Message: message, Cause: cause, Index: f.index})
+}
+
+// bump moves the index on and wakes up watches, the caller holds the lock
+func (f *fakeEtcd) bump() {
+	f.index++
+	close(f.changed)
+	f.changed = make(chan struct{})
+}
+
+func (f *fakeEtcd) value(key string) (string, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	node, ok := f.nodes["/"+key]
+	if !ok {
+		return "", false
+	}
+
+	return node.Value, true
+}
+
+// startEtcd runs a fake etcd and returns its store location prefix
+func startEtcd(t *testing.T) (*fakeEtcd, string, func()) {
+	fake := newFakeEtcd()
+	server := httptest.NewServer(fake)
+
+	return fake, "etcd://" + server.Listener.Addr().String(), server.Close
+}
+
+func TestEtcdStoreAuthenticates(t *testing.T) {
+	fake, location, stop := startEtcd(t)
+	defer stop()
+	fake.username, fake.password = "alice", "secret"
+
+	address := strings.TrimPrefix(location, "etcd://")
+	cs, err := Open("etcd://alice:secret@" + address + "/team")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := mustGet(t, cs)
+	s.Entries = append(s.Entries, testEntry("example.com", "alice"))
+	if err := cs.PersistStorageContainer(s); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := fake.value("team/creds"); !ok {
+		t.Fatal("the container isn't stored below the prefix")
+	}
+
+	if _, err := Open("etcd://alice:wrong@" + address + "/team"); err == nil {
+		t.Fatal("opened a store with the wrong password")
+	}
+}
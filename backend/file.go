@@ -0,0 +1,331 @@
+package backend
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/BurntSushi/toml"
+	"github.com/docker/libkv/store"
+)
+
+const (
+	// FileFormatJSON and FileFormatTOML are the formats a FileStore can write
+	FileFormatJSON = "json"
+	FileFormatTOML = "toml"
+
+	// lockSuffix names the file we flock, the store itself is replaced on
+	// every write so it can't hold the lock
+	lockSuffix = ".lock"
+)
+
+// fileContainer is the content of a store file
+type fileContainer struct {
+	Schema int `json:"schema" toml:"schema"`
+	// Generation is bumped on every write, it is the LastIndex of the container
+	Generation uint64  `json:"generation" toml:"generation"`
+	MasterKey  string  `json:"master_key,omitempty" toml:"master_key,omitempty"`
+	Entries    []Entry `json:"entries" toml:"entries"`
+}
+
+// FileStore keeps the whole store in a JSON or TOML file that can be read and
+// diffed, e.g. in a dotfiles repository. Writes go to a temporary file that is
+// renamed over the store while holding a flock on a lock file next to it.
+type FileStore struct {
+	path   string
+	format string
+}
+
+// IsFileStoreLocation reports whether the location names a JSON or TOML file
+func IsFileStoreLocation(storeLocation string) bool {
+	return fileFormat(storeLocation) != ""
+}
+
+// OpenFileStore opens the store file and brings it to the current schema, its
+// format follows the .json or .toml extension and defaults to JSON
+func OpenFileStore(storeLocation string) (*FileStore, error) {
+	fs, err := OpenFileStoreUnmigrated(storeLocation)
+	if err != nil {
+		return nil, err
+	}
+	// refuse a file written by a newer version right away, and migrate an older
+	// one before anybody reads it
+	if _, err := fs.Migrate(false); err != nil {
+		return nil, err
+	}
+
+	return fs, nil
+}
+
+// OpenFileStoreUnmigrated opens the store file as it is, so pending migrations
+// can be inspected first
+func OpenFileStoreUnmigrated(storeLocation string) (*FileStore, error) {
+	if err := prepareStoreFile(storeLocation); err != nil {
+		return nil, err
+	}
+
+	format := fileFormat(storeLocation)
+	if format == "" {
+		format = FileFormatJSON
+	}
+
+	return &FileStore{
+		path:   storeLocation,
+		format: format,
+	}, nil
+}
+
+// GetStorageContainer reads the store file, a missing file is an empty store
+func (fs *FileStore) GetStorageContainer() (*StorageContainer, error) {
+	var fc *fileContainer
+
+	err := fs.withLock(syscall.LOCK_SH, func() error {
+		var err error
+		fc, err = fs.read()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &StorageContainer{
+		MasterKey: fc.MasterKey,
+		Entries:   fc.Entries,
+		LastIndex: fc.Generation,
+	}, nil
+}
+
+// PersistStorageContainer replaces the store file. It fails with
+// store.ErrKeyModified when another process wrote it since s was read.
+func (fs *FileStore) PersistStorageContainer(s *StorageContainer) error {
+	return fs.withLock(syscall.LOCK_EX, func() error {
+		current, err := fs.read()
+		if err != nil {
+			return err
+		}
+
+		if current.Generation != s.LastIndex {
+			return store.ErrKeyModified
+		}
+
+		fc := &fileContainer{
+			Schema:     CurrentSchemaVersion,
+			Generation: current.Generation + 1,
+			MasterKey:  s.MasterKey,
+			Entries:    s.Entries,
+		}
+
+		if err := fs.write(fc); err != nil {
+			return err
+		}
+
+		s.LastIndex = fc.Generation
+		return nil
+	})
+}
+
+// Migrate brings the store file up to CurrentSchemaVersion. The file as it
+// was is kept next to it, named after the backup key with the old schema. With
+// dryRun set nothing is written, the returned steps are the ones that would run.
+func (fs *FileStore) Migrate(dryRun bool) ([]MigrationStep, error) {
+	var steps []MigrationStep
+
+	how := syscall.LOCK_EX
+	if dryRun {
+		how = syscall.LOCK_SH
+	}
+
+	err := fs.withLock(how, func() error {
+		fc, data, err := fs.readFile()
+		if err != nil {
+			return err
+		}
+
+		steps = pendingMigrations(fc.Schema)
+		if len(steps) == 0 || dryRun {
+			return nil
+		}
+
+		backup := fs.path + "." + backupKeyPrefix + strconv.Itoa(fc.Schema)
+		if err := ioutil.WriteFile(backup, data, storeFileMode); err != nil {
+			return err
+		}
+
+		migrated, err := migrateFileContainer(fc)
+		if err != nil {
+			return err
+		}
+		// writers that read the file before the migration must read it again
+		migrated.Generation++
+
+		return fs.write(migrated)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return steps, nil
+}
+
+// migrateFileContainer runs the pending migrations on the content of a store
+// file written with an older schema
+func migrateFileContainer(fc *fileContainer) (*fileContainer, error) {
+	value, err := json.Marshal(&persistedContainer{
+		MasterKey: fc.MasterKey,
+		Entries:   fc.Entries,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	value, err = applyMigrations(value, fc.Schema)
+	if err != nil {
+		return nil, err
+	}
+
+	ret, _, err := decodeContainer(value)
+	if err != nil {
+		return nil, err
+	}
+
+	return &fileContainer{
+		Schema:     CurrentSchemaVersion,
+		Generation: fc.Generation,
+		MasterKey:  ret.MasterKey,
+		Entries:    ret.Entries,
+	}, nil
+}
+
+// read decodes the store file and migrates its content in memory when it was
+// written with an older schema, the caller holds the lock
+func (fs *FileStore) read() (*fileContainer, error) {
+	fc, _, err := fs.readFile()
+	if err != nil {
+		return nil, err
+	}
+
+	if fc.Schema < CurrentSchemaVersion {
+		return migrateFileContainer(fc)
+	}
+
+	return fc, nil
+}
+
+// readFile decodes the store file as it is and returns its raw content as
+// well, a file written by a newer version is refused
+func (fs *FileStore) readFile() (*fileContainer, []byte, error) {
+	fc := &fileContainer{
+		Schema:  CurrentSchemaVersion,
+		Entries: make([]Entry, 0),
+	}
+
+	data, err := ioutil.ReadFile(fs.path)
+	if os.IsNotExist(err) {
+		return fc, nil, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if fs.format == FileFormatTOML {
+		err = toml.Unmarshal(data, fc)
+	} else {
+		err = json.Unmarshal(data, fc)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if fc.Schema > CurrentSchemaVersion {
+		return nil, nil, ErrSchemaTooNew
+	}
+
+	if fc.Entries == nil {
+		fc.Entries = make([]Entry, 0)
+	}
+
+	return fc, data, nil
+}
+
+// write replaces the store file through a temporary file in the same
+// directory, so readers see either the old or the new content
+func (fs *FileStore) write(fc *fileContainer) error {
+	var data []byte
+	var err error
+
+	if fs.format == FileFormatTOML {
+		var buf bytes.Buffer
+		err = toml.NewEncoder(&buf).Encode(fc)
+		data = buf.Bytes()
+	} else {
+		data, err = json.MarshalIndent(fc, "", "  ")
+		data = append(data, '\n')
+	}
+	if err != nil {
+		return err
+	}
+
+	// the temporary file must be on the same file system for the rename, Split
+	// would return an empty directory, which is $TMPDIR, for a relative path
+	tmp, err := ioutil.TempFile(filepath.Dir(fs.path), "."+filepath.Base(fs.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	// a no-op once the rename went through
+	defer os.Remove(tmp.Name())
+
+	if err := tmp.Chmod(storeFileMode); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), fs.path)
+}
+
+// withLock runs fn holding a flock of the provided type on the lock file
+func (fs *FileStore) withLock(how int, fn func() error) error {
+	lock, err := os.OpenFile(fs.path+lockSuffix, os.O_RDWR|os.O_CREATE, storeFileMode)
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+
+	if err := syscall.Flock(int(lock.Fd()), how); err != nil {
+		return err
+	}
+	// closing the file releases the lock as well
+	defer syscall.Flock(int(lock.Fd()), syscall.LOCK_UN)
+
+	return fn()
+}
+
+// fileFormat returns the format for the extension of the location, if any
+func fileFormat(storeLocation string) string {
+	switch strings.ToLower(filepath.Ext(storeLocation)) {
+	case "." + FileFormatJSON:
+		return FileFormatJSON
+	case "." + FileFormatTOML:
+		return FileFormatTOML
+	default:
+		return ""
+	}
+}
@@ -0,0 +1,119 @@
+package backend
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"strconv"
+	"testing"
+)
+
+func TestFileStoreMigrates(t *testing.T) {
+	for _, name := range []string{"store.json", "store.toml"} {
+		name := name
+		t.Run(name, func(t *testing.T) {
+			path, cleanup := tempStorePath(t, name)
+			defer cleanup()
+
+			fs, err := OpenFileStore(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			s := mustGet(t, fs)
+			s.Entries = append(s.Entries, testEntry("example.com", "alice"))
+			if err := fs.PersistStorageContainer(s); err != nil {
+				t.Fatal(err)
+			}
+
+			before, err := ioutil.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			version := CurrentSchemaVersion
+			defer withTestMigration()()
+
+			// a handle that didn't migrate the file still reads the new schema
+			got := mustGet(t, &FileStore{path: path, format: fs.format})
+			if got.Entries[0].Username != "ALICE" {
+				t.Fatalf("read %+v from a file on an older schema", got.Entries)
+			}
+
+			steps, err := fs.Migrate(true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(steps) != 1 || steps[0].From != version {
+				t.Fatalf("the dry run listed %v", steps)
+			}
+
+			fs, err = OpenFileStore(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			fc, _, err := fs.readFile()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if fc.Schema != CurrentSchemaVersion || fc.Generation != s.LastIndex+1 || fc.Entries[0].Username != "ALICE" {
+				t.Fatalf("migrated to %+v", fc)
+			}
+
+			backup, err := ioutil.ReadFile(path + "." + backupKeyPrefix + strconv.Itoa(version))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(backup, before) {
+				t.Fatalf("kept %s as the backup of %s", backup, before)
+			}
+		})
+	}
+}
+
+func TestFileStoreRefusesNewerSchema(t *testing.T) {
+	path, cleanup := tempStorePath(t, "store.json")
+	defer cleanup()
+
+	data, err := json.Marshal(&fileContainer{Schema: CurrentSchemaVersion + 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, data, storeFileMode); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := OpenFileStore(path); !errors.Is(err, ErrSchemaTooNew) {
+		t.Fatalf("opening a newer store file gave %v", err)
+	}
+}
+
+func TestFileStoreDryRunChangesNothing(t *testing.T) {
+	path, cleanup := tempStorePath(t, "store.json")
+	defer cleanup()
+
+	legacy := []byte(`{"schema":0,"generation":3,"entries":[]}`)
+	if err := ioutil.WriteFile(path, legacy, storeFileMode); err != nil {
+		t.Fatal(err)
+	}
+
+	cs, err := OpenUnmigrated(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	steps, err := cs.(Migrator).Migrate(true)
+	if err != nil || len(steps) != 1 {
+		t.Fatalf("the dry run listed %v, %v", steps, err)
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, legacy) {
+		t.Fatalf("the dry run rewrote the file to %s", data)
+	}
+	if _, err := ioutil.ReadFile(path + "." + backupKeyPrefix + "0"); err == nil {
+		t.Fatal("the dry run kept a backup")
+	}
+}
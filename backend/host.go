@@ -0,0 +1,36 @@
+package backend
+
+// HostStore is implemented by backends that keep the entries of every host
+// apart. The container they return for a host holds only its entries and the
+// ones without a host, which match any host, so a command about one host
+// doesn't read or write the rest of the store.
+type HostStore interface {
+	GetHostContainer(host string) (*StorageContainer, error)
+	PersistHostContainer(host string, s *StorageContainer) error
+}
+
+// hostView is the CryptStoreInterface over the entries of one host of a HostStore
+type hostView struct {
+	store HostStore
+	host  string
+}
+
+// ForHost returns a CryptStoreInterface over the entries a request for host
+// can match. Backends that aren't a HostStore, or an empty host, get the whole
+// container.
+func ForHost(cs CryptStoreInterface, host string) CryptStoreInterface {
+	hs, ok := cs.(HostStore)
+	if !ok || host == "" {
+		return cs
+	}
+
+	return &hostView{store: hs, host: host}
+}
+
+func (hv *hostView) GetStorageContainer() (*StorageContainer, error) {
+	return hv.store.GetHostContainer(hv.host)
+}
+
+func (hv *hostView) PersistStorageContainer(s *StorageContainer) error {
+	return hv.store.PersistHostContainer(hv.host, s)
+}
@@ -0,0 +1,75 @@
+package backend
+
+import (
+	"sync"
+
+	"github.com/docker/libkv/store"
+)
+
+// memoryStores holds the memory stores by name, so opening the same name twice
+// in a process gives the same store
+var memoryStores = struct {
+	sync.Mutex
+	byName map[string]*MemoryStore
+}{byName: make(map[string]*MemoryStore)}
+
+// MemoryStore keeps the container in memory only, it is gone when the process
+// exits. It is meant for tests and for trying the helper out.
+type MemoryStore struct {
+	mu         sync.Mutex
+	masterKey  string
+	entries    []Entry
+	generation uint64
+}
+
+// NewMemoryStore returns an empty store of its own
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		entries: make([]Entry, 0),
+	}
+}
+
+// OpenMemoryStore returns the memory store with the provided name, creating it
+// on first use
+func OpenMemoryStore(name string) *MemoryStore {
+	memoryStores.Lock()
+	defer memoryStores.Unlock()
+
+	ms, ok := memoryStores.byName[name]
+	if !ok {
+		ms = NewMemoryStore()
+		memoryStores.byName[name] = ms
+	}
+
+	return ms
+}
+
+// GetStorageContainer returns a copy of the container
+func (ms *MemoryStore) GetStorageContainer() (*StorageContainer, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	return &StorageContainer{
+		MasterKey: ms.masterKey,
+		Entries:   append(make([]Entry, 0, len(ms.entries)), ms.entries...),
+		LastIndex: ms.generation,
+	}, nil
+}
+
+// PersistStorageContainer replaces the container. It fails with
+// store.ErrKeyModified when another writer persisted since s was read.
+func (ms *MemoryStore) PersistStorageContainer(s *StorageContainer) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	if ms.generation != s.LastIndex {
+		return store.ErrKeyModified
+	}
+
+	ms.masterKey = s.MasterKey
+	ms.entries = append(make([]Entry, 0, len(s.Entries)), s.Entries...)
+	ms.generation++
+	s.LastIndex = ms.generation
+
+	return nil
+}
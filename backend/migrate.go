@@ -0,0 +1,172 @@
+package backend
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/docker/libkv/store"
+)
+
+const (
+	// schemaKey holds the schema version of the container stored under credKey
+	schemaKey = "schema"
+	// backupKeyPrefix names the copies of the container kept before a migration
+	backupKeyPrefix = "creds-backup-v"
+)
+
+// ErrSchemaTooNew is returned when the store was written by a newer version
+var ErrSchemaTooNew = errors.New("migration failure: the store was written by a newer version")
+
+// Migrator is implemented by stores that can bring what they hold up to
+// CurrentSchemaVersion
+type Migrator interface {
+	Migrate(dryRun bool) ([]MigrationStep, error)
+}
+
+// migration moves a stored container from the previous schema version to
+// version. As the schema key is written after the container, apply must also
+// accept a container that was already migrated.
+type migration struct {
+	version     int
+	description string
+	apply       func(value []byte) ([]byte, error)
+}
+
+// migrations holds every schema change in order. New migrations are appended,
+// old ones must never be removed or reordered.
+var migrations = []migration{
+	{
+		version:     1,
+		description: "store credentials as typed JSON entries instead of URLs",
+		apply:       migrateCredentialURLs,
+	},
+}
+
+// CurrentSchemaVersion is the schema version written by this version
+var CurrentSchemaVersion = migrations[len(migrations)-1].version
+
+// MigrationStep describes a migration that ran or would run
+type MigrationStep struct {
+	From        int
+	To          int
+	Description string
+}
+
+func (m MigrationStep) String() string {
+	if m.From == m.To {
+		return fmt.Sprintf("schema %d: %s", m.To, m.Description)
+	}
+
+	return fmt.Sprintf("schema %d to %d: %s", m.From, m.To, m.Description)
+}
+
+// Migrate brings the stored container up to CurrentSchemaVersion. The value
+// before the migration is kept under a backup key. With dryRun set nothing is
+// written, the returned steps are the ones that would run.
+func (cs *CryptStore) Migrate(dryRun bool) ([]MigrationStep, error) {
+	version, err := cs.schemaVersion()
+	if err != nil {
+		return nil, err
+	}
+
+	if version > CurrentSchemaVersion {
+		return nil, ErrSchemaTooNew
+	}
+
+	steps := pendingMigrations(version)
+	if len(steps) == 0 || dryRun {
+		return steps, nil
+	}
+
+	pair, err := cs.db.Get(cs.key(credKey))
+	if err == store.ErrKeyNotFound {
+		// nothing stored yet, a new store starts out on the current schema
+		return steps, cs.setSchemaVersion(CurrentSchemaVersion)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	err = cs.db.Put(cs.key(backupKeyPrefix+strconv.Itoa(version)), pair.Value, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	value, err := applyMigrations(pair.Value, version)
+	if err != nil {
+		return nil, err
+	}
+	// the container only changes if nobody wrote it in the meantime
+	_, _, err = cs.db.AtomicPut(cs.key(credKey), value, pair, nil)
+	if err == store.ErrKeyModified {
+		// another process wrote the store first, maybe migrating it, start over
+		return cs.Migrate(dryRun)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return steps, cs.setSchemaVersion(CurrentSchemaVersion)
+}
+
+// pendingMigrations returns the steps needed to bring version up to date
+func pendingMigrations(version int) []MigrationStep {
+	var steps []MigrationStep
+
+	for _, m := range migrations {
+		if m.version > version {
+			steps = append(steps, MigrationStep{From: m.version - 1, To: m.version, Description: m.description})
+		}
+	}
+
+	return steps
+}
+
+// applyMigrations runs every migration after version on a stored container
+func applyMigrations(value []byte, version int) ([]byte, error) {
+	var err error
+
+	for _, m := range migrations {
+		if m.version <= version {
+			continue
+		}
+
+		value, err = m.apply(value)
+		if err != nil {
+			return nil, fmt.Errorf("migration to schema %d failed: %s", m.version, err)
+		}
+	}
+
+	return value, nil
+}
+
+// schemaVersion returns the stored schema version, stores from before the
+// schema key are version 0
+func (cs *CryptStore) schemaVersion() (int, error) {
+	pair, err := cs.db.Get(cs.key(schemaKey))
+	if err == store.ErrKeyNotFound {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	return strconv.Atoi(string(pair.Value))
+}
+
+func (cs *CryptStore) setSchemaVersion(version int) error {
+	return cs.db.Put(cs.key(schemaKey), []byte(strconv.Itoa(version)), nil)
+}
+
+// migrateCredentialURLs converts a container holding credentials in the URL
+// form, with or without a master key, to typed entries
+func migrateCredentialURLs(value []byte) ([]byte, error) {
+	ret, _, err := decodeContainer(value)
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(&ret)
+}
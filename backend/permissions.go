@@ -0,0 +1,117 @@
+package backend
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	// storeFileMode and storeDirMode are what new stores and their directory get
+	storeFileMode = 0600
+	storeDirMode  = 0700
+)
+
+// ErrInsecurePermissions is returned when a store file can be read by someone
+// else than its owner, or isn't owned by us
+var ErrInsecurePermissions = errors.New("insecure store file permissions")
+
+// insecureWarning reports insecure store files instead of refusing them when set
+var insecureWarning func(err error)
+
+// WarnOnInsecurePermissions makes opening a store file that fails the
+// permission check only report it through warn, a nil warn refuses such files
+// again
+func WarnOnInsecurePermissions(warn func(err error)) {
+	insecureWarning = warn
+}
+
+// checkPermissions refuses a store file that others can access or that belongs
+// to another user, the way ssh treats private keys. A missing file is fine, it
+// is created with storeFileMode.
+func checkPermissions(path string) error {
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	err = nil
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok && int(stat.Uid) != os.Getuid() {
+		err = fmt.Errorf("%w: %s is owned by uid %d, not by you", ErrInsecurePermissions, path, stat.Uid)
+	} else if perm := info.Mode().Perm(); perm&0077 != 0 {
+		err = fmt.Errorf("%w: %s is accessible by others (%04o), run chmod 600 %s", ErrInsecurePermissions, path, perm, path)
+	}
+
+	if err != nil && insecureWarning != nil {
+		insecureWarning(err)
+		return nil
+	}
+
+	return err
+}
+
+// prepareStoreFile checks the permissions of a local store file and creates its
+// directory, accessible by us only, when there is none yet
+func prepareStoreFile(path string) error {
+	if err := os.MkdirAll(filepath.Dir(path), storeDirMode); err != nil {
+		return err
+	}
+
+	return checkPermissions(path)
+}
+
+// prepareBoltFile is prepareStoreFile for a bolt file, a store libkv created
+// for earlier versions is made accessible by us only first
+func prepareBoltFile(path string) error {
+	if err := tightenLibkvStore(path); err != nil {
+		return err
+	}
+
+	return prepareStoreFile(path)
+}
+
+// tightenLibkvStore changes a bolt file libkv created readable by everyone, as
+// it did for every store before the native format, to storeFileMode. Only a
+// file of ours that others can't write and that holds the libkv bucket but
+// wasn't converted yet is changed, anything else is left to the permission
+// check.
+func tightenLibkvStore(path string) error {
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	perm := info.Mode().Perm()
+	if perm&0077 == 0 || perm&0022 != 0 || !info.Mode().IsRegular() {
+		return nil
+	}
+	if stat, ok := info.Sys().(*syscall.Stat_t); !ok || int(stat.Uid) != os.Getuid() {
+		return nil
+	}
+
+	db, err := bolt.Open(path, storeFileMode, &bolt.Options{ReadOnly: true, Timeout: boltTimeout})
+	if err != nil {
+		return err
+	}
+	libkv := false
+	err = db.View(func(tx *bolt.Tx) error {
+		libkv = tx.Bucket([]byte(boltBaseString)) != nil && tx.Bucket([]byte(metaBucket)) == nil
+		return nil
+	})
+	db.Close()
+	if err != nil || !libkv {
+		return err
+	}
+
+	return os.Chmod(path, storeFileMode)
+}
@@ -0,0 +1,281 @@
+package backend
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/libkv/store"
+)
+
+const (
+	// SchemeBolt, SchemeFile, SchemeMemory, SchemeConsul, SchemeEtcd and
+	// SchemeZooKeeper are the store locations understood out of the box
+	SchemeBolt      = "bolt"
+	SchemeFile      = "file"
+	SchemeMemory    = "memory"
+	SchemeConsul    = "consul"
+	SchemeEtcd      = "etcd"
+	SchemeZooKeeper = "zk"
+
+	// defaultKVPrefix keeps our keys apart in a shared key-value store
+	defaultKVPrefix = "git-credential-crypt-store"
+	kvTimeout       = 10 * time.Second
+)
+
+// Opener opens the store a location points at without migrating it
+type Opener func(location *url.URL) (CryptStoreInterface, error)
+
+var openers = struct {
+	sync.Mutex
+	byScheme map[string]Opener
+}{byScheme: map[string]Opener{
+	SchemeBolt:      openBoltLocation,
+	SchemeFile:      openFileLocation,
+	SchemeMemory:    openMemoryLocation,
+	SchemeConsul:    openKVLocation(store.CONSUL),
+	SchemeEtcd:      openKVLocation(store.ETCD),
+	SchemeZooKeeper: openKVLocation(store.ZK),
+}}
+
+// Register makes a backend available under the scheme of store locations, a
+// later registration of the same scheme replaces the earlier one
+func Register(scheme string, opener Opener) {
+	openers.Lock()
+	defer openers.Unlock()
+
+	openers.byScheme[strings.ToLower(scheme)] = opener
+}
+
+// Schemes returns the registered schemes in order
+func Schemes() []string {
+	openers.Lock()
+	defer openers.Unlock()
+
+	schemes := make([]string, 0, len(openers.byScheme))
+	for scheme := range openers.byScheme {
+		schemes = append(schemes, scheme)
+	}
+	sort.Strings(schemes)
+
+	return schemes
+}
+
+// Open opens the store at location and brings it to the current schema. The
+// location is a URI such as bolt:///path or etcd://host:port/prefix, a plain
+// path is a JSON or TOML file by its extension and a bolt database otherwise.
+func Open(location string) (CryptStoreInterface, error) {
+	cs, err := OpenUnmigrated(location)
+	if err != nil {
+		return nil, err
+	}
+
+	if m, ok := cs.(Migrator); ok {
+		if _, err := m.Migrate(false); err != nil {
+			return nil, err
+		}
+	}
+
+	return cs, nil
+}
+
+// OpenUnmigrated opens the store at location as it is, so pending migrations
+// can be inspected first
+func OpenUnmigrated(location string) (CryptStoreInterface, error) {
+	u, err := parseLocation(location)
+	if err != nil {
+		return nil, err
+	}
+
+	openers.Lock()
+	opener, ok := openers.byScheme[u.Scheme]
+	openers.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown store location scheme %q, use one of %s", u.Scheme, strings.Join(Schemes(), ", "))
+	}
+
+	return opener(u)
+}
+
+// parseLocation turns a plain path into the URI of the backend it always used
+func parseLocation(location string) (*url.URL, error) {
+	if !strings.Contains(location, "://") {
+		scheme := SchemeBolt
+		if IsFileStoreLocation(location) {
+			scheme = SchemeFile
+		}
+
+		return &url.URL{Scheme: scheme, Path: location}, nil
+	}
+
+	u, err := url.Parse(location)
+	if err != nil {
+		return nil, fmt.Errorf("invalid store location %q: %s", location, err)
+	}
+	u.Scheme = strings.ToLower(u.Scheme)
+
+	return u, nil
+}
+
+// localPath returns the path of a location on this machine
+func localPath(location *url.URL) (string, error) {
+	if location.Host != "" && location.Host != "localhost" {
+		return "", fmt.Errorf("%s store locations can't name a host, got %q", location.Scheme, location.Host)
+	}
+
+	if location.Path == "" {
+		return "", fmt.Errorf("%s store locations need a path", location.Scheme)
+	}
+
+	return location.Path, nil
+}
+
+func openBoltLocation(location *url.URL) (CryptStoreInterface, error) {
+	path, err := localPath(location)
+	if err != nil {
+		return nil, err
+	}
+
+	return OpenBoltStoreUnmigrated(path)
+}
+
+func openFileLocation(location *url.URL) (CryptStoreInterface, error) {
+	path, err := localPath(location)
+	if err != nil {
+		return nil, err
+	}
+
+	return OpenFileStoreUnmigrated(path)
+}
+
+// openMemoryLocation opens a memory store, memory://name shares the store with
+// every other opener of that name in the process
+func openMemoryLocation(location *url.URL) (CryptStoreInterface, error) {
+	return OpenMemoryStore(location.Host + location.Path), nil
+}
+
+// openKVLocation returns the opener of a libkv backend. The container is kept
+// below the path of the location, or below git-credential-crypt-store without
+// one. The query configures the connection:
+//
+//	tls=true            connect with TLS, implied by the options below
+//	ca=/path            PEM file of the certificate authorities to trust
+//	cert=/path&key=/path client certificate and key
+//	watch=true          cache the container and watch the store for changes
+//
+// A username and password in the location authenticate to etcd.
+func openKVLocation(kind store.Backend) Opener {
+	return func(location *url.URL) (CryptStoreInterface, error) {
+		if location.Host == "" {
+			return nil, fmt.Errorf("%s store locations need a host, e.g. %s://localhost:%s/prefix", location.Scheme, location.Scheme, defaultPorts[kind])
+		}
+
+		options, err := kvOptions(location)
+		if err != nil {
+			return nil, err
+		}
+
+		return OpenCryptStoreUnmigrated(kind, strings.Split(location.Host, ","), options)
+	}
+}
+
+// defaultPorts only serve as examples in errors
+var defaultPorts = map[store.Backend]string{
+	store.CONSUL: "8500",
+	store.ETCD:   "2379",
+	store.ZK:     "2181",
+}
+
+// kvOptions reads the options of a key-value store location
+func kvOptions(location *url.URL) (*KVOptions, error) {
+	query := location.Query()
+
+	options := &KVOptions{
+		Prefix:            strings.Trim(location.Path, "/"),
+		ConnectionTimeout: kvTimeout,
+	}
+	if options.Prefix == "" {
+		options.Prefix = defaultKVPrefix
+	}
+
+	if location.User != nil {
+		options.Username = location.User.Username()
+		options.Password, _ = location.User.Password()
+	}
+
+	var err error
+	if options.Watch, err = queryBool(query, "watch"); err != nil {
+		return nil, err
+	}
+
+	useTLS, err := queryBool(query, "tls")
+	if err != nil {
+		return nil, err
+	}
+
+	ca, cert, key := query.Get("ca"), query.Get("cert"), query.Get("key")
+	if useTLS || ca != "" || cert != "" || key != "" {
+		if options.TLS, err = TLSConfig(ca, cert, key); err != nil {
+			return nil, err
+		}
+	}
+
+	return options, nil
+}
+
+// queryBool reads a boolean option, a missing one is false
+func queryBool(query url.Values, name string) (bool, error) {
+	value := query.Get(name)
+	if value == "" {
+		return false, nil
+	}
+
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("invalid value %q for store option %s", value, name)
+	}
+
+	return b, nil
+}
+
+// TLSConfig returns the TLS configuration for a key-value store. The CA file
+// replaces the system roots when it is set, the certificate and key files
+// must be set together.
+func TLSConfig(caFile, certFile, keyFile string) (*tls.Config, error) {
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if caFile != "" {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", caFile)
+		}
+	}
+
+	if (certFile == "") != (keyFile == "") {
+		return nil, errors.New("a client certificate needs both cert and key")
+	}
+
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	return config, nil
+}
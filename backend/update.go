@@ -0,0 +1,63 @@
+package backend
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/docker/libkv/store"
+)
+
+var (
+	// updateAttempts is how often Update tries before giving up
+	updateAttempts = 10
+	// updateBackoff is the first wait between attempts, it doubles every time
+	updateBackoff = 10 * time.Millisecond
+	// updateMaxBackoff caps the wait between attempts
+	updateMaxBackoff = time.Second
+)
+
+// ErrTooManyConflicts is returned by Update when other writers changed the store
+// on every attempt
+var ErrTooManyConflicts = errors.New("the store kept being changed by other processes, gave up updating it")
+
+// Mutation changes the container read from the store. It reports whether
+// anything changed, an unchanged container isn't written.
+type Mutation func(s *StorageContainer) (bool, error)
+
+// Update reads the container, applies mutate and persists the result. When
+// another writer got in between, the container is read again and mutate runs
+// on the new content, after a growing random wait so parallel git processes
+// don't keep colliding. mutate must therefore work on the container it gets
+// and nothing it changed on an earlier attempt.
+func Update(cs CryptStoreInterface, mutate Mutation) error {
+	backoff := updateBackoff
+
+	for attempt := 1; ; attempt++ {
+		s, err := cs.GetStorageContainer()
+		if err != nil {
+			return err
+		}
+
+		changed, err := mutate(s)
+		if err != nil || !changed {
+			return err
+		}
+
+		err = cs.PersistStorageContainer(s)
+		if err != store.ErrKeyModified {
+			return err
+		}
+
+		if attempt == updateAttempts {
+			return fmt.Errorf("%w after %d attempts", ErrTooManyConflicts, attempt)
+		}
+
+		// wait between half and all of the backoff
+		time.Sleep(backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1)))
+		if backoff *= 2; backoff > updateMaxBackoff {
+			backoff = updateMaxBackoff
+		}
+	}
+}
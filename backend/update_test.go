@@ -0,0 +1,124 @@
+package backend
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/docker/libkv/store"
+)
+
+// conflictingStore is changed by someone else before every write
+type conflictingStore struct {
+	*MemoryStore
+	persists int
+}
+
+func (cs *conflictingStore) PersistStorageContainer(s *StorageContainer) error {
+	cs.persists++
+
+	other, err := cs.MemoryStore.GetStorageContainer()
+	if err != nil {
+		return err
+	}
+	if err := cs.MemoryStore.PersistStorageContainer(other); err != nil {
+		return err
+	}
+
+	return cs.MemoryStore.PersistStorageContainer(s)
+}
+
+func TestUpdateGivesUp(t *testing.T) {
+	// the real backoff would sleep for seconds
+	backoff, maxBackoff := updateBackoff, updateMaxBackoff
+	updateBackoff, updateMaxBackoff = time.Microsecond, time.Millisecond
+	defer func() { updateBackoff, updateMaxBackoff = backoff, maxBackoff }()
+
+	cs := &conflictingStore{MemoryStore: NewMemoryStore()}
+
+	mutations := 0
+	err := Update(cs, func(s *StorageContainer) (bool, error) {
+		mutations++
+		s.Entries = append(s.Entries, testEntry("example.com", "alice"))
+		return true, nil
+	})
+	if !errors.Is(err, ErrTooManyConflicts) {
+		t.Fatalf("updating a store that always changes gave %v", err)
+	}
+	if mutations != updateAttempts || cs.persists != updateAttempts {
+		t.Fatalf("%d mutations and %d writes, expected %d attempts", mutations, cs.persists, updateAttempts)
+	}
+}
+
+func TestUpdateRetriesOnTheNewContent(t *testing.T) {
+	ms := NewMemoryStore()
+
+	first := true
+	err := Update(ms, func(s *StorageContainer) (bool, error) {
+		if first {
+			// another process writes after we read
+			first = false
+			other, err := ms.GetStorageContainer()
+			if err != nil {
+				return false, err
+			}
+			other.Entries = append(other.Entries, testEntry("example.org", "bob"))
+			if err := ms.PersistStorageContainer(other); err != nil {
+				return false, err
+			}
+		}
+
+		s.Entries = append(s.Entries, testEntry("example.com", "alice"))
+		return true, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := ms.GetStorageContainer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(s.Entries) != 2 || s.Entries[0].Username != "bob" || s.Entries[1].Username != "alice" {
+		t.Fatalf("the retry lost a write, the store holds %+v", s.Entries)
+	}
+}
+
+func TestUpdateUnchanged(t *testing.T) {
+	cs := &conflictingStore{MemoryStore: NewMemoryStore()}
+
+	err := Update(cs, func(s *StorageContainer) (bool, error) {
+		return false, nil
+	})
+	if err != nil || cs.persists != 0 {
+		t.Fatalf("an unchanged container gave %v after %d writes", err, cs.persists)
+	}
+
+	failure := errors.New("mutation failed")
+	err = Update(cs, func(s *StorageContainer) (bool, error) {
+		return true, failure
+	})
+	if err != failure || cs.persists != 0 {
+		t.Fatalf("a failed mutation gave %v after %d writes", err, cs.persists)
+	}
+}
+
+func TestUpdateKeepsOtherErrors(t *testing.T) {
+	err := Update(failingStore{}, func(s *StorageContainer) (bool, error) {
+		return true, nil
+	})
+	if err != store.ErrNotReachable {
+		t.Fatalf("a failed write gave %v", err)
+	}
+}
+
+// failingStore can be read but never written
+type failingStore struct{}
+
+func (failingStore) GetStorageContainer() (*StorageContainer, error) {
+	return &StorageContainer{Entries: make([]Entry, 0)}, nil
+}
+
+func (failingStore) PersistStorageContainer(s *StorageContainer) error {
+	return store.ErrNotReachable
+}
@@ -0,0 +1,141 @@
+package backend
+
+import (
+	"sync"
+
+	"github.com/docker/libkv/store"
+)
+
+// containerCache keeps the container of a CryptStore between reads. It is only
+// trusted while a watch on the key runs, every change the watch reports from
+// another writer drops it.
+type containerCache struct {
+	mu       sync.Mutex
+	pair     *store.KVPair
+	watching bool
+	// disabled is set once the backend turned out not to support watches
+	disabled bool
+	stopCh   chan struct{}
+}
+
+// get returns the cached container, nil when it has to be read
+func (c *containerCache) get() *store.KVPair {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.watching {
+		return nil
+	}
+
+	return c.pair
+}
+
+// set caches the container as read or written by us
+func (c *containerCache) set(pair *store.KVPair) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.pair = pair
+}
+
+// invalidate drops the cached container
+func (c *containerCache) invalidate() {
+	c.set(nil)
+}
+
+// changed drops the container when the watch saw a write that isn't the one
+// we cached
+func (c *containerCache) changed(pair *store.KVPair) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.pair != nil && c.pair.LastIndex != pair.LastIndex {
+		c.pair = nil
+	}
+}
+
+// start records that a watch runs, it reports false when one already does or
+// watches don't work
+func (c *containerCache) start() (chan struct{}, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.watching || c.disabled {
+		return nil, false
+	}
+
+	c.watching = true
+	c.stopCh = make(chan struct{})
+
+	return c.stopCh, true
+}
+
+// stopped records that the watch ended, nothing cached can be trusted after it
+func (c *containerCache) stopped(disable bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.watching = false
+	c.disabled = c.disabled || disable
+	c.pair = nil
+}
+
+// stop ends the watch, if any
+func (c *containerCache) stop() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.stopCh != nil {
+		close(c.stopCh)
+		c.stopCh = nil
+	}
+	c.disabled = true
+}
+
+// getContainer reads the container key, from the cache when it is kept
+func (cs *CryptStore) getContainer() (*store.KVPair, error) {
+	if cs.cache != nil {
+		if pair := cs.cache.get(); pair != nil {
+			return pair, nil
+		}
+	}
+
+	pair, err := cs.db.Get(cs.key(credKey))
+	if err != nil {
+		return nil, err
+	}
+
+	cs.cacheContainer(pair)
+
+	return pair, nil
+}
+
+// cacheContainer keeps pair when caching is on and starts the watch once the
+// key exists, some backends can't watch a missing key
+func (cs *CryptStore) cacheContainer(pair *store.KVPair) {
+	if cs.cache == nil {
+		return
+	}
+
+	cs.cache.set(pair)
+
+	stopCh, ok := cs.cache.start()
+	if !ok {
+		return
+	}
+
+	events, err := cs.db.Watch(cs.key(credKey), stopCh)
+	if err != nil {
+		// e.g. bolt, which can't watch, reads the file every time
+		cs.cache.stopped(true)
+		return
+	}
+
+	go func() {
+		for event := range events {
+			cs.cache.changed(event)
+		}
+		// the watch gave up, e.g. the connection broke
+		cs.cache.stopped(false)
+	}()
+}
@@ -0,0 +1,74 @@
+package backend
+
+import (
+	"github.com/docker/libkv/store"
+)
+
+// zooKeeperStore counts the versions of ZooKeeper nodes from one. ZooKeeper
+// creates a node at version 0, which a StorageContainer takes for a container
+// that was never written, so every write after the first would conflict.
+type zooKeeperStore struct {
+	store.Store
+}
+
+// fromZooKeeper returns pair with the index we use for its version
+func fromZooKeeper(pair *store.KVPair) *store.KVPair {
+	if pair == nil {
+		return nil
+	}
+
+	ret := *pair
+	ret.LastIndex++
+
+	return &ret
+}
+
+// toZooKeeper returns pair with the version ZooKeeper uses for its index
+func toZooKeeper(pair *store.KVPair) *store.KVPair {
+	if pair == nil {
+		return nil
+	}
+
+	ret := *pair
+	ret.LastIndex--
+
+	return &ret
+}
+
+// Get reads key
+func (zs zooKeeperStore) Get(key string) (*store.KVPair, error) {
+	pair, err := zs.Store.Get(key)
+
+	return fromZooKeeper(pair), err
+}
+
+// Watch reports every change of key
+func (zs zooKeeperStore) Watch(key string, stopCh <-chan struct{}) (<-chan *store.KVPair, error) {
+	events, err := zs.Store.Watch(key, stopCh)
+	if err != nil {
+		return nil, err
+	}
+
+	ret := make(chan *store.KVPair)
+	go func() {
+		defer close(ret)
+
+		for pair := range events {
+			ret <- fromZooKeeper(pair)
+		}
+	}()
+
+	return ret, nil
+}
+
+// AtomicPut writes key if it is still at the version of previous
+func (zs zooKeeperStore) AtomicPut(key string, value []byte, previous *store.KVPair, options *store.WriteOptions) (bool, *store.KVPair, error) {
+	ok, pair, err := zs.Store.AtomicPut(key, value, toZooKeeper(previous), options)
+
+	return ok, fromZooKeeper(pair), err
+}
+
+// AtomicDelete removes key if it is still at the version of previous
+func (zs zooKeeperStore) AtomicDelete(key string, previous *store.KVPair) (bool, error) {
+	return zs.Store.AtomicDelete(key, toZooKeeper(previous))
+}
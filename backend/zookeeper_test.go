@@ -0,0 +1,403 @@
+package backend
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"path"
+	"sync"
+	"testing"
+
+	"github.com/samuel/go-zookeeper/zk"
+)
+
+// the parts of the ZooKeeper protocol the fake speaks
+const (
+	zkOpCreate     = 1
+	zkOpExists     = 3
+	zkOpGetData    = 4
+	zkOpSetData    = 5
+	zkOpPing       = 11
+	zkOpSetWatches = 101
+	zkOpClose      = -11
+
+	zkXidWatchEvent      = -1
+	zkStateSyncConnected = 3
+
+	zkErrMarshalling   = -5
+	zkErrUnimplemented = -6
+	zkErrNoNode        = -101
+	zkErrBadVersion    = -103
+	zkErrNodeExists    = -110
+)
+
+// fakeZooKeeper serves the part of the ZooKeeper protocol libkv uses:
+// sessions kept alive by pings, exists, create, reads with data watches and
+// versioned writes. Nodes have no children lists or ACLs.
+type fakeZooKeeper struct {
+	listener net.Listener
+	wg       sync.WaitGroup
+
+	mu       sync.Mutex
+	zxid     int64
+	nodes    map[string]*zkNode
+	sessions map[*zkSession]bool
+	lastID   int64
+	closed   bool
+}
+
+type zkNode struct {
+	data    []byte
+	version int32
+	czxid   int64
+	mzxid   int64
+}
+
+// zkSession is the connection of a client, data watches are kept per session
+// and fire once the way ZooKeeper does
+type zkSession struct {
+	conn    net.Conn
+	writeMu sync.Mutex
+	// watches is guarded by the lock of the fake
+	watches map[string]bool
+}
+
+// zkPacket builds a packet of the wire format, big endian numbers and length
+// prefixed strings and buffers
+type zkPacket struct {
+	bytes.Buffer
+}
+
+func (p *zkPacket) int32(v int32) {
+	binary.Write(&p.Buffer, binary.BigEndian, v)
+}
+
+func (p *zkPacket) int64(v int64) {
+	binary.Write(&p.Buffer, binary.BigEndian, v)
+}
+
+func (p *zkPacket) buffer(b []byte) {
+	if b == nil {
+		p.int32(-1)
+		return
+	}
+
+	p.int32(int32(len(b)))
+	p.Write(b)
+}
+
+func (p *zkPacket) string(s string) {
+	p.buffer([]byte(s))
+}
+
+func (p *zkPacket) stat(n *zkNode) {
+	p.int64(n.czxid)
+	p.int64(n.mzxid)
+	p.int64(0) // ctime
+	p.int64(0) // mtime
+	p.int32(n.version)
+	p.int32(0) // cversion
+	p.int32(0) // aversion
+	p.int64(0) // ephemeral owner
+	p.int32(int32(len(n.data)))
+	p.int32(0) // number of children
+	p.int64(0) // pzxid
+}
+
+// zkReader reads a packet, the first short read sets err and every later read
+// returns zero values
+type zkReader struct {
+	buf []byte
+	err error
+}
+
+func (r *zkReader) next(n int) []byte {
+	if r.err != nil || n < 0 || len(r.buf) < n {
+		r.err = io.ErrUnexpectedEOF
+		return nil
+	}
+
+	b := r.buf[:n]
+	r.buf = r.buf[n:]
+
+	return b
+}
+
+func (r *zkReader) int32() int32 {
+	b := r.next(4)
+	if b == nil {
+		return 0
+	}
+
+	return int32(binary.BigEndian.Uint32(b))
+}
+
+func (r *zkReader) int64() int64 {
+	b := r.next(8)
+	if b == nil {
+		return 0
+	}
+
+	return int64(binary.BigEndian.Uint64(b))
+}
+
+func (r *zkReader) bool() bool {
+	b := r.next(1)
+
+	return b != nil && b[0] != 0
+}
+
+func (r *zkReader) buffer() []byte {
+	n := r.int32()
+	if n == -1 {
+		return nil
+	}
+
+	return append([]byte{}, r.next(int(n))...)
+}
+
+func (r *zkReader) string() string {
+	return string(r.buffer())
+}
+
+// readZKPacket reads a length prefixed packet
+func readZKPacket(conn net.Conn) ([]byte, error) {
+	var length int32
+	if err := binary.Read(conn, binary.BigEndian, &length); err != nil {
+		return nil, err
+	}
+	if length < 0 {
+		return nil, io.ErrUnexpectedEOF
+	}
+
+	packet := make([]byte, length)
+	_, err := io.ReadFull(conn, packet)
+
+	return packet, err
+}
+
+// send writes a packet with its length in front
+func (s *zkSession) send(p *zkPacket) error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+
+	var length zkPacket
+	length.int32(int32(p.Len()))
+	_, err := s.conn.Write(append(length.Bytes(), p.Bytes()...))
+
+	return err
+}
+
+// reply answers the request xid, a reply with an error code has no body
+func (s *zkSession) reply(xid int32, zxid int64, code int32, body *zkPacket) error {
+	var p zkPacket
+	p.int32(xid)
+	p.int64(zxid)
+	p.int32(code)
+	if code == 0 && body != nil {
+		p.Write(body.Bytes())
+	}
+
+	return s.send(&p)
+}
+
+func newFakeZooKeeper(listener net.Listener) *fakeZooKeeper {
+	return &fakeZooKeeper{
+		listener: listener,
+		nodes:    make(map[string]*zkNode),
+		sessions: make(map[*zkSession]bool),
+	}
+}
+
+func (f *fakeZooKeeper) accept() {
+	defer f.wg.Done()
+
+	for {
+		conn, err := f.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		f.wg.Add(1)
+		go f.serve(conn)
+	}
+}
+
+func (f *fakeZooKeeper) serve(conn net.Conn) {
+	defer f.wg.Done()
+	defer conn.Close()
+
+	session := &zkSession{conn: conn, watches: make(map[string]bool)}
+	f.mu.Lock()
+	if f.closed {
+		f.mu.Unlock()
+		return
+	}
+	f.lastID++
+	id := f.lastID
+	f.sessions[session] = true
+	f.mu.Unlock()
+
+	defer func() {
+		f.mu.Lock()
+		delete(f.sessions, session)
+		f.mu.Unlock()
+	}()
+
+	packet, err := readZKPacket(conn)
+	if err != nil {
+		return
+	}
+	connect := &zkReader{buf: packet}
+	connect.int32() // protocol version
+	connect.int64() // last zxid seen
+	timeout := connect.int32()
+
+	var accepted zkPacket
+	accepted.int32(0) // protocol version
+	accepted.int32(timeout)
+	accepted.int64(id)
+	accepted.buffer(make([]byte, 16))
+	if err := session.send(&accepted); err != nil {
+		return
+	}
+
+	for {
+		packet, err := readZKPacket(conn)
+		if err != nil {
+			return
+		}
+
+		r := &zkReader{buf: packet}
+		xid, op := r.int32(), r.int32()
+
+		zxid, code, body := f.handle(session, op, r)
+		if err := session.reply(xid, zxid, code, body); err != nil || op == zkOpClose {
+			return
+		}
+	}
+}
+
+// handle runs a request and returns the zxid, error code and body of the reply
+func (f *fakeZooKeeper) handle(session *zkSession, op int32, r *zkReader) (int64, int32, *zkPacket) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	body := new(zkPacket)
+	code := int32(0)
+
+	switch op {
+	case zkOpPing, zkOpSetWatches, zkOpClose:
+		body = nil
+	case zkOpExists:
+		// watches on missing nodes aren't kept, libkv doesn't set them
+		node, ok := f.nodes[r.string()]
+		r.bool()
+		if !ok {
+			code = zkErrNoNode
+			break
+		}
+		body.stat(node)
+	case zkOpGetData:
+		key := r.string()
+		watch := r.bool()
+		node, ok := f.nodes[key]
+		if !ok {
+			code = zkErrNoNode
+			break
+		}
+		if watch {
+			session.watches[key] = true
+		}
+		body.buffer(node.data)
+		body.stat(node)
+	case zkOpSetData:
+		key, data, version := r.string(), r.buffer(), r.int32()
+		node, ok := f.nodes[key]
+		if !ok {
+			code = zkErrNoNode
+			break
+		}
+		if version != -1 && version != node.version {
+			code = zkErrBadVersion
+			break
+		}
+		f.zxid++
+		node.data, node.mzxid = data, f.zxid
+		node.version++
+		f.dataChanged(key)
+		body.stat(node)
+	case zkOpCreate:
+		key, data := r.string(), r.buffer()
+		for acls := r.int32(); acls > 0 && r.err == nil; acls-- {
+			r.int32()  // permissions
+			r.string() // scheme
+			r.string() // id
+		}
+		r.int32() // flags
+		if _, ok := f.nodes[key]; ok {
+			code = zkErrNodeExists
+			break
+		}
+		if parent := path.Dir(key); parent != "/" && f.nodes[parent] == nil {
+			code = zkErrNoNode
+			break
+		}
+		f.zxid++
+		f.nodes[key] = &zkNode{data: data, czxid: f.zxid, mzxid: f.zxid}
+		body.string(key)
+	default:
+		code = zkErrUnimplemented
+	}
+
+	if r.err != nil {
+		code = zkErrMarshalling
+	}
+
+	return f.zxid, code, body
+}
+
+// dataChanged fires the data watches on key, the caller holds the lock
+func (f *fakeZooKeeper) dataChanged(key string) {
+	for session := range f.sessions {
+		if !session.watches[key] {
+			continue
+		}
+		delete(session.watches, key)
+
+		var event zkPacket
+		event.int32(int32(zk.EventNodeDataChanged))
+		event.int32(zkStateSyncConnected)
+		event.string(key)
+		session.reply(zkXidWatchEvent, -1, 0, &event)
+	}
+}
+
+// stop closes the listener and every session and waits for them to end
+func (f *fakeZooKeeper) stop() {
+	f.listener.Close()
+
+	f.mu.Lock()
+	f.closed = true
+	for session := range f.sessions {
+		session.conn.Close()
+	}
+	f.mu.Unlock()
+
+	f.wg.Wait()
+}
+
+// startZooKeeper runs a fake ZooKeeper and returns its store location prefix
+func startZooKeeper(t *testing.T) (*fakeZooKeeper, string, func()) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fake := newFakeZooKeeper(listener)
+	fake.wg.Add(1)
+	go fake.accept()
+
+	return fake, "zk://" + listener.Addr().String(), fake.stop
+}
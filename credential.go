@@ -8,8 +8,13 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"time"
 )
 
+// capabilityAuthType is the capability git advertises when it understands
+// authtype and credential instead of username and password
+const capabilityAuthType = "authtype"
+
 type Credential struct {
 	Username string
 	Password string
@@ -18,6 +23,27 @@ type Credential struct {
 	Path     string
 	URL      string
 	Quit     int
+	// Capability lists the protocol extensions git understands
+	Capability []string
+	// AuthType and Credential replace username and password for schemes such as Bearer
+	AuthType   string
+	Credential string
+	// Ephemeral marks a credential that must not be persisted
+	Ephemeral         bool
+	PasswordExpiryUTC string
+	// OAuthRefreshToken is kept encrypted next to the access token it renews
+	OAuthRefreshToken string
+	// WWWAuth holds the WWW-Authenticate headers sent by the server
+	WWWAuth []string
+	// State is opaque helper state that git hands back on store and erase
+	State []string
+	// secretHash and refreshTokenHash let erase and store check the stored
+	// secrets without decrypting them
+	secretHash       string
+	refreshTokenHash string
+	// entryID and metadata belong to a stored credential
+	entryID  uint64
+	metadata entryMetadata
 }
 
 func (c *Credential) ToURL() (*url.URL, error) {
@@ -56,14 +82,114 @@ func (c *Credential) ToURL() (*url.URL, error) {
 	return u, nil
 }
 
+// Identity returns the credential without its secret in URL form. It names the
+// credential when talking to the daemon.
+func (c *Credential) Identity() (string, error) {
+	identity := &Credential{
+		Protocol: c.Protocol,
+		Host:     c.Host,
+		Path:     c.Path,
+		Username: c.Username,
+	}
+
+	u, err := identity.ToURL()
+	if err != nil {
+		return "", err
+	}
+
+	return u.String(), nil
+}
+
+// AdditionalData returns the credential identity that is bound to its ciphertext.
+// It is built from the identity fields as they are stored, so store and get
+// agree on it.
+func (c *Credential) AdditionalData() []byte {
+	return formatAdditionalData(c)
+}
+
+// urlAdditionalData returns the identity that was bound to ciphertexts while it
+// was read back from the URL form, which e.g. puts a slash in front of the path.
+// Secrets sealed that way must keep decrypting.
+func (c *Credential) urlAdditionalData() ([]byte, error) {
+	identity, err := c.Identity()
+	if err != nil {
+		return nil, err
+	}
+
+	stored := new(Credential)
+	if err := parseCredentialURL(identity, stored); err != nil {
+		return nil, err
+	}
+
+	return formatAdditionalData(stored), nil
+}
+
+func formatAdditionalData(c *Credential) []byte {
+	return []byte(fmt.Sprintf("protocol=%s\nhost=%s\npath=%s\nusername=%s\n",
+		c.Protocol, c.Host, c.Path, c.Username))
+}
+
 func (c *Credential) IsValidToStore() bool {
+	// ensure we know where the credential belongs
+	if c.Protocol == "" || (c.Host == "" && c.Path == "") {
+		return false
+	}
 	// ensure we actually have stuff to store
-	return !(c.Protocol == "" || !(c.Host == "" || c.Path == "") || c.Username == "" || c.Password == "")
+	return (c.Username != "" && c.Password != "") || (c.AuthType != "" && c.Credential != "")
+}
+
+// PasswordExpiry returns when the password expires, git sends it as unix seconds.
+// The bool is false when the credential doesn't expire.
+func (c *Credential) PasswordExpiry() (time.Time, bool) {
+	if c.PasswordExpiryUTC == "" {
+		return time.Time{}, false
+	}
+
+	seconds, err := strconv.ParseInt(c.PasswordExpiryUTC, 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+
+	return time.Unix(seconds, 0).UTC(), true
 }
 
-func (c *Credential) PrintToStdOut() {
-	fmt.Fprintf(os.Stdout, "username=%s\n", c.Username)
-	fmt.Fprintf(os.Stdout, "password=%s\n", c.Password)
+// Expired reports whether the password expired at the provided time
+func (c *Credential) Expired(now time.Time) bool {
+	expiry, ok := c.PasswordExpiry()
+
+	return ok && !now.Before(expiry)
+}
+
+// HasCapability reports whether git advertised the capability
+func (c *Credential) HasCapability(capability string) bool {
+	for _, elem := range c.Capability {
+		if elem == capability {
+			return true
+		}
+	}
+
+	return false
+}
+
+// PrintToStdOut writes the credential for git. The authtype and credential are
+// only sent when git advertised it understands them.
+func (c *Credential) PrintToStdOut(capabilities []string) {
+	request := &Credential{Capability: capabilities}
+	if c.AuthType != "" && c.Credential != "" && request.HasCapability(capabilityAuthType) {
+		fmt.Fprintf(os.Stdout, "capability[]=%s\n", capabilityAuthType)
+		fmt.Fprintf(os.Stdout, "authtype=%s\n", c.AuthType)
+		fmt.Fprintf(os.Stdout, "credential=%s\n", c.Credential)
+	}
+	if c.Username != "" || c.Password != "" {
+		fmt.Fprintf(os.Stdout, "username=%s\n", c.Username)
+		fmt.Fprintf(os.Stdout, "password=%s\n", c.Password)
+	}
+	if c.PasswordExpiryUTC != "" {
+		fmt.Fprintf(os.Stdout, "password_expiry_utc=%s\n", c.PasswordExpiryUTC)
+	}
+	if c.OAuthRefreshToken != "" {
+		fmt.Fprintf(os.Stdout, "oauth_refresh_token=%s\n", c.OAuthRefreshToken)
+	}
 }
 
 func CredentialsMatch(want *Credential, have *Credential) bool {
@@ -129,7 +255,7 @@ func ParseCredentialStdin() (*Credential, error) {
 		}
 		// if the line is empty, we are done getting data from the git credential service
 		if len(line) == 0 {
-			break
+			return c, nil
 		}
 
 		parts := strings.SplitN(string(line), "=", 2)
@@ -139,6 +265,12 @@ func ParseCredentialStdin() (*Credential, error) {
 
 		key := parts[0]
 		value := parts[1]
+		// multi-valued keys end in [], an empty value resets the list
+		if strings.HasSuffix(key, "[]") {
+			parseListValue(strings.TrimSuffix(key, "[]"), value, c)
+			continue
+		}
+
 		switch key {
 		case "username":
 			c.Username = value
@@ -158,12 +290,53 @@ func ParseCredentialStdin() (*Credential, error) {
 			if err := parseQuit(value, c); err != nil {
 				return nil, err
 			}
+		case "authtype":
+			c.AuthType = value
+		case "credential":
+			c.Credential = value
+		case "ephemeral":
+			c.Ephemeral = parseBool(value)
+		case "password_expiry_utc":
+			c.PasswordExpiryUTC = value
+		case "oauth_refresh_token":
+			c.OAuthRefreshToken = value
 		default:
 			// do nothing
 		}
 	}
+}
+
+func parseListValue(key string, value string, c *Credential) {
+	var list *[]string
+
+	switch key {
+	case "capability":
+		list = &c.Capability
+	case "wwwauth":
+		list = &c.WWWAuth
+	case "state":
+		list = &c.State
+	default:
+		// ignore unknown lists
+		return
+	}
+
+	if value == "" {
+		*list = nil
+		return
+	}
 
-	return nil, nil
+	*list = append(*list, value)
+}
+
+// parseBool follows git's boolean values, anything unknown is false
+func parseBool(value string) bool {
+	switch strings.ToLower(value) {
+	case "1", "true", "yes", "on":
+		return true
+	default:
+		return false
+	}
 }
 
 func parseCredentialURL(rawurl string, c *Credential) error {
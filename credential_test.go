@@ -0,0 +1,57 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/king-jam/git-credential-crypt-store/crypto"
+)
+
+func TestAdditionalDataOfURLForm(t *testing.T) {
+	mk, err := crypto.NewMasterKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// git sends the path without a leading slash, the URL form adds one
+	c := testCredential("example.com", "alice", "secret")
+	c.Path = "team/repo.git"
+
+	legacy, err := c.urlAdditionalData()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(legacy) == string(c.AdditionalData()) {
+		t.Fatal("the URL form keeps the path as it is, the test needs another identity")
+	}
+
+	for name, aad := range map[string][]byte{"current": c.AdditionalData(), "URL form": legacy} {
+		sealed := *c
+		ciphertext, err := mk.Encrypt([]byte(c.Password), aad)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sealed.Password = string(ciphertext)
+
+		if err := decryptSecrets(&sealed, mk.Decrypt); err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+		if sealed.Password != "secret" {
+			t.Fatalf("%s: decrypted %q", name, sealed.Password)
+		}
+	}
+
+	// a secret moved to another identity still fails
+	moved := *c
+	ciphertext, err := mk.Encrypt([]byte(c.Password), legacy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	moved.Password = string(ciphertext)
+	moved.Username = "mallory"
+	if err := decryptSecrets(&moved, mk.Decrypt); err == nil {
+		t.Fatal("decrypted a secret bound to another identity")
+	}
+	if moved.Password != string(ciphertext) {
+		t.Fatal("a failed decryption changed the secret")
+	}
+}
@@ -5,7 +5,6 @@ import (
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/rand"
-	"crypto/sha256"
 	"errors"
 	"fmt"
 	"io"
@@ -18,26 +17,29 @@ var (
 	ErrDecryptionKeyMismatch = errors.New("decryption failure: current key not able to decrypt")
 )
 
-// Cipher stores the necessary encryption interface and latest key version
+// Cipher stores the password and the KDF parameters used to derive the
+// AES-256 key for each entry
 type Cipher struct {
-	gcm cipher.AEAD
+	password []byte
+	params   KDFParams
 }
 
-// NewCipher creates an AES-256 block cipher to encrypt/decrypt data
+// NewCipher creates a Cipher to encrypt/decrypt data using the default KDF parameters
 func NewCipher(password string) (*Cipher, error) {
-	hasher := sha256.New()
-
-	_, err := hasher.Write([]byte(password))
-	if err != nil {
-		return nil, ErrCryptoManager(err.Error())
-	}
+	return NewCipherWithParams(password, DefaultKDFParams)
+}
 
-	aesgcm, err := buildCipher(hasher.Sum(nil))
-	if err != nil {
+// NewCipherWithParams creates a Cipher that derives keys for new entries with
+// the provided Argon2id cost parameters
+func NewCipherWithParams(password string, params KDFParams) (*Cipher, error) {
+	if err := params.Validate(); err != nil {
 		return nil, ErrCryptoManager(err.Error())
 	}
 
-	return &Cipher{gcm: aesgcm}, nil
+	return &Cipher{
+		password: []byte(password),
+		params:   params,
+	}, nil
 }
 
 func buildCipher(keySlice []byte) (cipher.AEAD, error) {
@@ -54,18 +56,34 @@ func buildCipher(keySlice []byte) (cipher.AEAD, error) {
 	return aesgcm, nil
 }
 
-// Encrypt will take a plaintext byte array, encrypt it, and encode to a storageLayout
-func (c *Cipher) Encrypt(plaintext []byte) ([]byte, error) {
-	nonce := make([]byte, c.gcm.NonceSize())
+// Encrypt will take a plaintext byte array, encrypt it with a key derived from
+// a fresh random salt, and encode to a storageLayout. The additional data is
+// authenticated but not stored, so the same value must be passed to Decrypt.
+func (c *Cipher) Encrypt(plaintext []byte, additionalData []byte) ([]byte, error) {
+	salt := make([]byte, saltLength)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return []byte{}, ErrCryptoManager(err.Error())
+	}
+
+	gcm, err := buildCipher(deriveKey(c.password, salt, c.params))
+	if err != nil {
+		return []byte{}, ErrCryptoManager(err.Error())
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
 	// don't care about how many bytes are read back
 	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
 		return []byte{}, ErrCryptoManager(err.Error())
 	}
 
-	ciphertext := c.gcm.Seal(nil, nonce, plaintext, nil)
+	ciphertext := gcm.Seal(nil, nonce, plaintext, additionalData)
 	sl := storageLayout{
-		nonce: nonce,
-		value: ciphertext,
+		kdf:    KDFArgon2id,
+		params: c.params,
+		salt:   salt,
+		suite:  CipherAES256GCM,
+		nonce:  nonce,
+		value:  ciphertext,
 	}
 
 	storageCiphertext, err := sl.Encode()
@@ -77,7 +95,9 @@ func (c *Cipher) Encrypt(plaintext []byte) ([]byte, error) {
 }
 
 // Decrypt will take a []byte slice and storageLayout object and
-func (c *Cipher) Decrypt(storageCiphertext []byte) ([]byte, error) {
+// re-derive the key with the salt and parameters stored alongside it.
+// Layouts written before additional data was bound ignore additionalData.
+func (c *Cipher) Decrypt(storageCiphertext []byte, additionalData []byte) ([]byte, error) {
 	sl := new(storageLayout)
 
 	err := sl.Decode(storageCiphertext)
@@ -85,7 +105,33 @@ func (c *Cipher) Decrypt(storageCiphertext []byte) ([]byte, error) {
 		return []byte{}, ErrCryptoManager(err.Error())
 	}
 
-	plaintext, err := c.gcm.Open(nil, sl.Nonce(), sl.Value(), nil)
+	if sl.Suite() != CipherAES256GCM {
+		return []byte{}, ErrCryptoManager(fmt.Sprintf("unsupported cipher suite %q", sl.Suite()))
+	}
+
+	var key []byte
+	switch sl.KDF() {
+	case KDFSHA256:
+		key, err = deriveLegacyKey(c.password)
+		if err != nil {
+			return []byte{}, ErrCryptoManager(err.Error())
+		}
+	case KDFArgon2id:
+		key = deriveKey(c.password, sl.Salt(), sl.Params())
+	default:
+		return []byte{}, ErrCryptoManager(fmt.Sprintf("unsupported kdf %q", sl.KDF()))
+	}
+
+	gcm, err := buildCipher(key)
+	if err != nil {
+		return []byte{}, ErrCryptoManager(err.Error())
+	}
+
+	if !sl.BindsAdditionalData() {
+		additionalData = nil
+	}
+
+	plaintext, err := gcm.Open(nil, sl.Nonce(), sl.Value(), additionalData)
 	if err != nil {
 		return []byte{}, ErrCryptoManager(err.Error())
 	}
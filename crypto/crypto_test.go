@@ -0,0 +1,144 @@
+package crypto
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// testKDFParams keep the tests fast, they are far too cheap for real use
+var testKDFParams = KDFParams{Time: 1, Memory: 64, Threads: 1}
+
+// sealLegacy encrypts plaintext the way the layouts before additional data did
+// and returns the nonce and ciphertext
+func sealLegacy(t *testing.T, key []byte, plaintext []byte) ([]byte, []byte) {
+	gcm, err := buildCipher(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	// a nonce that encodes to something starting with the version prefix
+	nonce[0] = 0xBC
+
+	return nonce, gcm.Seal(nil, nonce, plaintext, nil)
+}
+
+func encodeParts(parts ...[]byte) []byte {
+	fields := make([]string, len(parts))
+	for idx, part := range parts {
+		fields[idx] = string(part)
+	}
+
+	return []byte(strings.Join(fields, storageDelimiter))
+}
+
+func b64(b []byte) []byte {
+	return []byte(base64EncodingType.EncodeToString(b))
+}
+
+func TestMovedCiphertextFails(t *testing.T) {
+	c, err := NewCipherWithParams("passphrase", testKDFParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mk, err := NewMasterKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, fns := range map[string]struct {
+		encrypt func([]byte, []byte) ([]byte, error)
+		decrypt func([]byte, []byte) ([]byte, error)
+	}{
+		"passphrase": {c.Encrypt, c.Decrypt},
+		"master key": {mk.Encrypt, mk.Decrypt},
+	} {
+		ciphertext, err := fns.encrypt([]byte("secret"), []byte("https://alice@example.com"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		plaintext, err := fns.decrypt(ciphertext, []byte("https://alice@example.com"))
+		if err != nil || string(plaintext) != "secret" {
+			t.Fatalf("%s: decrypted %q, %v", name, plaintext, err)
+		}
+
+		if _, err := fns.decrypt(ciphertext, []byte("https://mallory@example.com")); err == nil {
+			t.Fatalf("%s: a ciphertext moved to another credential decrypted", name)
+		}
+	}
+}
+
+func TestLegacyLayouts(t *testing.T) {
+	const password = "passphrase"
+
+	legacyKey, err := deriveLegacyKey([]byte(password))
+	if err != nil {
+		t.Fatal(err)
+	}
+	salt := bytes.Repeat([]byte{1}, saltLength)
+	saltedKey := deriveKey([]byte(password), salt, testKDFParams)
+	kdf := []byte(testKDFParams.String())
+
+	v0Nonce, v0Value := sealLegacy(t, legacyKey, []byte("v0 secret"))
+	v1Nonce, v1Value := sealLegacy(t, saltedKey, []byte("v1 secret"))
+	v2Nonce, v2Value := sealLegacy(t, saltedKey, []byte("v2 secret"))
+
+	tests := []struct {
+		name       string
+		ciphertext []byte
+		version    int
+		plaintext  string
+	}{
+		{"v0", encodeParts(b64(v0Nonce), b64(v0Value)), 0, "v0 secret"},
+		{"v1", encodeParts(kdf, b64(salt), b64(v1Nonce), b64(v1Value)), 1, "v1 secret"},
+		{"v2", encodeParts([]byte("v2"), kdf, b64(salt), []byte(CipherAES256GCM), b64(v2Nonce), b64(v2Value)), 2, "v2 secret"},
+	}
+
+	c, err := NewCipherWithParams(password, testKDFParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range tests {
+		version, _, err := layoutVersion(bytes.Split(test.ciphertext, []byte(storageDelimiter)))
+		if err != nil || version != test.version {
+			t.Fatalf("%s: read as version %d, %v", test.name, version, err)
+		}
+
+		// the old layouts were sealed without additional data, whatever is passed
+		plaintext, err := c.Decrypt(test.ciphertext, []byte("https://alice@example.com"))
+		if err != nil || string(plaintext) != test.plaintext {
+			t.Fatalf("%s: decrypted %q, %v", test.name, plaintext, err)
+		}
+	}
+
+	if _, _, err := layoutVersion(bytes.Split([]byte("a_b_c"), []byte(storageDelimiter))); err == nil {
+		t.Fatal("an unversioned value of three parts was accepted")
+	}
+}
+
+func TestParseKDFBounds(t *testing.T) {
+	for _, s := range []string{
+		DefaultKDFParams.String(),
+		"argon2id$m=1048576,t=32,p=64",
+	} {
+		if _, _, err := parseKDF(s); err != nil {
+			t.Fatalf("%s was rejected: %v", s, err)
+		}
+	}
+
+	for _, s := range []string{
+		"argon2id$m=4294967295,t=3,p=4",
+		"argon2id$m=1048577,t=3,p=4",
+		"argon2id$m=65536,t=4294967295,p=4",
+		"argon2id$m=65536,t=3,p=255",
+		"argon2id$m=65536,t=3,p=256",
+		"argon2id$m=0,t=3,p=4",
+	} {
+		if _, _, err := parseKDF(s); err != ErrKDFParams {
+			t.Fatalf("%s gave %v", s, err)
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package crypto
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"errors"
+)
+
+// ErrSecretHashFormat returns an error when a secret hash can not be parsed
+var ErrSecretHashFormat = errors.New("hash failure: invalid format")
+
+// HashSecret returns a salted Argon2id hash of a secret so it can be compared
+// to a stored one without the key to decrypt it. The format is
+// <kdf id and params><d><salt - base64><d><hash - base64>
+func HashSecret(secret []byte) ([]byte, error) {
+	salt, err := randomNonce(saltLength)
+	if err != nil {
+		return nil, ErrCryptoManager(err.Error())
+	}
+
+	return encodeSecretHash(DefaultKDFParams, salt, deriveKey(secret, salt, DefaultKDFParams)), nil
+}
+
+// VerifySecret reports whether secret is the one hashed by HashSecret
+func VerifySecret(hash []byte, secret []byte) (bool, error) {
+	parts := bytes.Split(hash, []byte(storageDelimiter))
+	if len(parts) != 3 {
+		return false, ErrSecretHashFormat
+	}
+
+	kdf, params, err := parseKDF(string(parts[0]))
+	if err != nil || kdf != KDFArgon2id {
+		return false, ErrSecretHashFormat
+	}
+
+	salt, err := decodePart(parts[1])
+	if err != nil {
+		return false, ErrSecretHashFormat
+	}
+
+	want, err := decodePart(parts[2])
+	if err != nil {
+		return false, ErrSecretHashFormat
+	}
+
+	return subtle.ConstantTimeCompare(deriveKey(secret, salt, params), want) == 1, nil
+}
+
+func encodeSecretHash(params KDFParams, salt []byte, sum []byte) []byte {
+	return []byte(params.String() + storageDelimiter +
+		base64EncodingType.EncodeToString(salt) + storageDelimiter +
+		base64EncodingType.EncodeToString(sum))
+}
@@ -0,0 +1,122 @@
+package crypto
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+)
+
+const (
+	// KDFArgon2id identifies the Argon2id key derivation function
+	KDFArgon2id = "argon2id"
+	// KDFSHA256 identifies the legacy unsalted single SHA-256 derivation
+	KDFSHA256 = "sha256"
+	// kdfParamsDelimiter splits the KDF id from its cost parameters
+	kdfParamsDelimiter = "$"
+	// keyLength is the AES-256 key size derived from a password
+	keyLength = 32
+	// saltLength is the size of the random per-entry salt
+	saltLength = 16
+	// maxKDFMemory, maxKDFTime and maxKDFThreads bound the parameters read
+	// from a store, a planted value could ask for terabytes of memory otherwise
+	maxKDFMemory  = 1024 * 1024 // 1 GiB in KiB
+	maxKDFTime    = 32
+	maxKDFThreads = 64
+)
+
+var (
+	// DefaultKDFParams are the Argon2id cost parameters used for new entries
+	DefaultKDFParams = KDFParams{
+		Time:    3,
+		Memory:  64 * 1024,
+		Threads: 4,
+	}
+	// ErrKDFParams returns an error when stored KDF parameters can not be parsed
+	ErrKDFParams = errors.New("kdf failure: invalid parameters")
+)
+
+// KDFParams holds the tunable Argon2id cost parameters. They are stored next
+// to the ciphertext so they can be raised later without breaking old entries.
+type KDFParams struct {
+	// Time is the number of passes over the memory
+	Time uint32
+	// Memory is the size of the memory in KiB
+	Memory uint32
+	// Threads is the degree of parallelism
+	Threads uint8
+}
+
+// Validate checks that the parameters are usable for key derivation and within
+// the bounds of what a store may ask for
+func (p KDFParams) Validate() error {
+	if p.Time == 0 || p.Memory == 0 || p.Threads == 0 {
+		return ErrKDFParams
+	}
+
+	if p.Time > maxKDFTime || p.Memory > maxKDFMemory || p.Threads > maxKDFThreads {
+		return ErrKDFParams
+	}
+
+	return nil
+}
+
+// String encodes the parameters in the form argon2id$m=<memory>,t=<time>,p=<threads>
+func (p KDFParams) String() string {
+	return fmt.Sprintf("%s%sm=%d,t=%d,p=%d", KDFArgon2id, kdfParamsDelimiter, p.Memory, p.Time, p.Threads)
+}
+
+// parseKDF decodes a KDF id with its optional parameters, as stored in the
+// storageLayout, e.g. argon2id$m=65536,t=3,p=4 or sha256
+func parseKDF(s string) (string, KDFParams, error) {
+	switch {
+	case s == KDFSHA256:
+		return KDFSHA256, KDFParams{}, nil
+	case strings.HasPrefix(s, KDFArgon2id+kdfParamsDelimiter):
+		p, err := parseKDFParams(s)
+		return KDFArgon2id, p, err
+	default:
+		return "", KDFParams{}, ErrKDFParams
+	}
+}
+
+// parseKDFParams decodes parameters encoded with KDFParams.String
+func parseKDFParams(s string) (KDFParams, error) {
+	var p KDFParams
+
+	parts := strings.SplitN(s, kdfParamsDelimiter, 2)
+	if len(parts) != 2 || parts[0] != KDFArgon2id {
+		return p, ErrKDFParams
+	}
+
+	n, err := fmt.Sscanf(parts[1], "m=%d,t=%d,p=%d", &p.Memory, &p.Time, &p.Threads)
+	if err != nil || n != 3 {
+		return p, ErrKDFParams
+	}
+
+	if err := p.Validate(); err != nil {
+		return p, err
+	}
+
+	return p, nil
+}
+
+// deriveKey stretches the password into an AES-256 key with Argon2id
+func deriveKey(password []byte, salt []byte, p KDFParams) []byte {
+	return argon2.IDKey(password, salt, p.Time, p.Memory, p.Threads, keyLength)
+}
+
+// deriveLegacyKey reproduces the original unsalted single SHA-256 derivation.
+// It is only used to decrypt entries written before the KDF was introduced.
+func deriveLegacyKey(password []byte) ([]byte, error) {
+	hasher := sha256.New()
+
+	_, err := hasher.Write(password)
+	if err != nil {
+		return nil, err
+	}
+
+	return hasher.Sum(nil), nil
+}
@@ -0,0 +1,278 @@
+package crypto
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"io"
+)
+
+const (
+	// KeyMasterKey identifies values keyed by a data key wrapped with the store master key
+	KeyMasterKey = "masterkey"
+	// masterKeyAdditionalData binds a wrapped master key to its purpose
+	masterKeyAdditionalData = "git-credential-crypt-store master key"
+	// integrityKeyLabel derives the key used by Sum from the master key
+	integrityKeyLabel = "git-credential-crypt-store integrity"
+)
+
+// ErrMasterKeyFormat returns an error when a master key has the wrong size
+var ErrMasterKeyFormat = errors.New("master key format is invalid")
+
+// MasterKey is the store-wide key. It never encrypts credentials directly,
+// instead it wraps a random data key per entry so changing the passphrase only
+// rewraps the master key itself.
+type MasterKey struct {
+	key []byte
+}
+
+// NewMasterKey generates a random master key for a new store
+func NewMasterKey() (*MasterKey, error) {
+	key, err := randomKey()
+	if err != nil {
+		return nil, ErrCryptoManager(err.Error())
+	}
+
+	return &MasterKey{key: key}, nil
+}
+
+// MasterKeyFromBytes restores a master key returned by Bytes, e.g. from the daemon
+func MasterKeyFromBytes(key []byte) (*MasterKey, error) {
+	if len(key) != keyLength {
+		return nil, ErrMasterKeyFormat
+	}
+
+	return &MasterKey{key: append([]byte{}, key...)}, nil
+}
+
+// UnwrapMasterKey decrypts a master key wrapped with Wrap using the store passphrase
+func UnwrapMasterKey(wrapped []byte, passphrase string) (*MasterKey, error) {
+	cipher, err := NewCipher(passphrase)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := cipher.Decrypt(wrapped, []byte(masterKeyAdditionalData))
+	if err != nil {
+		return nil, err
+	}
+
+	return MasterKeyFromBytes(key)
+}
+
+// Wrap encrypts the master key with a key derived from the store passphrase
+func (mk *MasterKey) Wrap(passphrase string) ([]byte, error) {
+	cipher, err := NewCipher(passphrase)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.Encrypt(mk.key, []byte(masterKeyAdditionalData))
+}
+
+// Bytes returns the raw master key
+func (mk *MasterKey) Bytes() []byte {
+	return append([]byte{}, mk.key...)
+}
+
+// Encrypt will take a plaintext byte array, encrypt it with a fresh random data
+// key, wrap the data key with the master key and encode both to a storageLayout.
+// The additional data is authenticated but not stored.
+func (mk *MasterKey) Encrypt(plaintext []byte, additionalData []byte) ([]byte, error) {
+	dataKey, err := randomKey()
+	if err != nil {
+		return []byte{}, ErrCryptoManager(err.Error())
+	}
+
+	wrappedKey, err := mk.wrapDataKey(dataKey)
+	if err != nil {
+		return []byte{}, ErrCryptoManager(err.Error())
+	}
+
+	gcm, err := buildCipher(dataKey)
+	if err != nil {
+		return []byte{}, ErrCryptoManager(err.Error())
+	}
+
+	nonce, err := randomNonce(gcm.NonceSize())
+	if err != nil {
+		return []byte{}, ErrCryptoManager(err.Error())
+	}
+
+	sl := storageLayout{
+		kdf:        KeyMasterKey,
+		wrappedKey: wrappedKey,
+		suite:      CipherAES256GCM,
+		nonce:      nonce,
+		value:      gcm.Seal(nil, nonce, plaintext, additionalData),
+	}
+
+	storageCiphertext, err := sl.Encode()
+	if err != nil {
+		return []byte{}, ErrCryptoManager(err.Error())
+	}
+
+	return storageCiphertext, nil
+}
+
+// Decrypt will take a []byte slice written by Encrypt, unwrap its data key and
+// return the plaintext
+func (mk *MasterKey) Decrypt(storageCiphertext []byte, additionalData []byte) ([]byte, error) {
+	sl := new(storageLayout)
+
+	err := sl.Decode(storageCiphertext)
+	if err != nil {
+		return []byte{}, ErrCryptoManager(err.Error())
+	}
+
+	if sl.KDF() != KeyMasterKey {
+		return []byte{}, ErrCryptoManager("value is not encrypted with the master key")
+	}
+
+	if sl.Suite() != CipherAES256GCM {
+		return []byte{}, ErrCryptoManager("unsupported cipher suite " + sl.Suite())
+	}
+
+	dataKey, err := mk.unwrapDataKey(sl.WrappedKey())
+	if err != nil {
+		return []byte{}, ErrCryptoManager(err.Error())
+	}
+
+	gcm, err := buildCipher(dataKey)
+	if err != nil {
+		return []byte{}, ErrCryptoManager(err.Error())
+	}
+
+	plaintext, err := gcm.Open(nil, sl.Nonce(), sl.Value(), additionalData)
+	if err != nil {
+		return []byte{}, ErrCryptoManager(err.Error())
+	}
+
+	return plaintext, nil
+}
+
+// RewrapDataKey moves a value encrypted by Encrypt from one master key to another.
+// Only the wrapped data key changes, the ciphertext itself is kept as is.
+func RewrapDataKey(storageCiphertext []byte, from *MasterKey, to *MasterKey) ([]byte, error) {
+	sl := new(storageLayout)
+
+	err := sl.Decode(storageCiphertext)
+	if err != nil {
+		return []byte{}, ErrCryptoManager(err.Error())
+	}
+
+	if sl.KDF() != KeyMasterKey {
+		return []byte{}, ErrCryptoManager("value is not encrypted with the master key")
+	}
+
+	dataKey, err := from.unwrapDataKey(sl.WrappedKey())
+	if err != nil {
+		return []byte{}, ErrCryptoManager(err.Error())
+	}
+
+	sl.wrappedKey, err = to.wrapDataKey(dataKey)
+	if err != nil {
+		return []byte{}, ErrCryptoManager(err.Error())
+	}
+
+	rewrapped, err := sl.Encode()
+	if err != nil {
+		return []byte{}, ErrCryptoManager(err.Error())
+	}
+
+	return rewrapped, nil
+}
+
+// Sum returns an HMAC-SHA256 of data keyed from the master key, so anyone who
+// can unlock the store can check the data wasn't tampered with
+func (mk *MasterKey) Sum(data []byte) []byte {
+	mac := hmac.New(sha256.New, mk.integrityKey())
+	// writes to a hash never fail
+	_, _ = mac.Write(data)
+
+	return mac.Sum(nil)
+}
+
+// Verify reports whether sum is the Sum of data
+func (mk *MasterKey) Verify(data []byte, sum []byte) bool {
+	return hmac.Equal(mk.Sum(data), sum)
+}
+
+// Equal reports whether both master keys are the same key
+func (mk *MasterKey) Equal(other *MasterKey) bool {
+	return hmac.Equal(mk.key, other.key)
+}
+
+// integrityKey derives a separate key for Sum so the master key is only ever
+// used for one purpose
+func (mk *MasterKey) integrityKey() []byte {
+	mac := hmac.New(sha256.New, mk.key)
+	// writes to a hash never fail
+	_, _ = mac.Write([]byte(integrityKeyLabel))
+
+	return mac.Sum(nil)
+}
+
+// wrapDataKey seals a data key with the master key - <nonce><sealed data key>
+func (mk *MasterKey) wrapDataKey(dataKey []byte) ([]byte, error) {
+	gcm, err := buildCipher(mk.key)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce, err := randomNonce(gcm.NonceSize())
+	if err != nil {
+		return nil, err
+	}
+
+	return gcm.Seal(nonce, nonce, dataKey, nil), nil
+}
+
+// unwrapDataKey opens a data key sealed by wrapDataKey
+func (mk *MasterKey) unwrapDataKey(wrappedKey []byte) ([]byte, error) {
+	gcm, err := buildCipher(mk.key)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(wrappedKey) < gcm.NonceSize() {
+		return nil, ErrKeyFormat
+	}
+
+	nonce := wrappedKey[:gcm.NonceSize()]
+
+	return gcm.Open(nil, nonce, wrappedKey[gcm.NonceSize():], nil)
+}
+
+// UsesMasterKey reports whether the value is encrypted with the store master key
+// rather than keyed directly by a passphrase
+func UsesMasterKey(storageCiphertext []byte) (bool, error) {
+	sl := new(storageLayout)
+
+	err := sl.Decode(storageCiphertext)
+	if err != nil {
+		return false, ErrCryptoManager(err.Error())
+	}
+
+	return sl.KDF() == KeyMasterKey, nil
+}
+
+func randomKey() ([]byte, error) {
+	key := make([]byte, keyLength)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return nil, err
+	}
+
+	return key, nil
+}
+
+func randomNonce(size int) ([]byte, error) {
+	nonce := make([]byte, size)
+	// don't care about how many bytes are read back
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+
+	return nonce, nil
+}
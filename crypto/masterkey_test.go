@@ -0,0 +1,85 @@
+package crypto
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestUnwrapMasterKey(t *testing.T) {
+	mk, err := NewMasterKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wrapped, err := mk.Wrap("passphrase")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	unwrapped, err := UnwrapMasterKey(wrapped, "passphrase")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !unwrapped.Equal(mk) {
+		t.Fatal("unwrapped another master key")
+	}
+
+	if _, err := UnwrapMasterKey(wrapped, "wrong"); err == nil {
+		t.Fatal("unwrapped the master key with the wrong passphrase")
+	}
+
+	// a wrapped master key is no credential ciphertext, and the other way round
+	c, err := NewCipher("passphrase")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Decrypt(wrapped, nil); err == nil {
+		t.Fatal("decrypted the wrapped master key as a credential")
+	}
+}
+
+func TestRewrapDataKey(t *testing.T) {
+	from, err := NewMasterKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	to, err := NewMasterKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	aad := []byte("https://alice@example.com")
+	ciphertext, err := from.Encrypt([]byte("secret"), aad)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rewrapped, err := RewrapDataKey(ciphertext, from, to)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	plaintext, err := to.Decrypt(rewrapped, aad)
+	if err != nil || string(plaintext) != "secret" {
+		t.Fatalf("decrypted %q, %v", plaintext, err)
+	}
+	if _, err := from.Decrypt(rewrapped, aad); err == nil {
+		t.Fatal("the old master key still decrypts the rewrapped value")
+	}
+
+	// only the wrapped data key changes
+	before, after := new(storageLayout), new(storageLayout)
+	if err := before.Decode(ciphertext); err != nil {
+		t.Fatal(err)
+	}
+	if err := after.Decode(rewrapped); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(before.Nonce(), after.Nonce()) || !bytes.Equal(before.Value(), after.Value()) {
+		t.Fatal("rewrapping changed the ciphertext")
+	}
+
+	if _, err := RewrapDataKey(ciphertext, to, from); err == nil {
+		t.Fatal("rewrapped with a master key that doesn't hold the data key")
+	}
+}
@@ -5,16 +5,26 @@ import (
 	"encoding/base64"
 	"errors"
 	"fmt"
+	"strconv"
+	"strings"
 )
 
 const (
 	// storageDelimiter is used to space the component of the storageLayout
 	// value. DO NOT CHANGE THIS A LOT OR WE WILL HAVE TO HANDLE MIGRATIONS.
 	storageDelimiter = "_"
-	// versionIndex stores the index in the storageLayout where version is
-	nonceIndex = 0
-	// nonceIndex stores the index in the storageLayout where the nonce is
-	valueIndex = 1
+	// versionPrefix marks the first part of a versioned storageLayout
+	versionPrefix = "v"
+	// passphraseLayoutVersion is the storageLayout version written for values
+	// keyed directly by a passphrase
+	passphraseLayoutVersion = 3
+	// masterKeyLayoutVersion is the storageLayout version written for values
+	// keyed by a data key wrapped with the store master key
+	masterKeyLayoutVersion = 4
+	// additionalDataLayoutVersion is the first version sealed with additional data
+	additionalDataLayoutVersion = 3
+	// CipherAES256GCM identifies the AES-256 in Galois/Counter Mode cipher suite
+	CipherAES256GCM = "aes256gcm"
 )
 
 var (
@@ -31,61 +41,94 @@ var (
 // storageLayout handles how the hash will be stored in the database
 // This helper type does Encoding/Decoding operations and accessor
 // methods to simplify working with the encrypted values.
-// the format is:
-// <nonce - base64><delimiter><ciphertext - base64>
+// the current formats are:
+// v4<d>masterkey<d><wrapped data key - base64><d><cipher suite><d><nonce - base64><d><ciphertext - base64>
+// v3<d><kdf id and params><d><salt - base64><d><cipher suite><d><nonce - base64><d><ciphertext - base64>
+// v3 and v4 bind the credential identity as additional data, older entries are
+// still readable but were sealed without it:
+// v2: the same fields as v3
+// v1 (unversioned): <kdf id and params><d><salt - base64><d><nonce - base64><d><ciphertext - base64>
+// v0 (unversioned): <nonce - base64><d><ciphertext - base64>
 // the delimiter cannot be any character within the base64 encoding range
+// or the KDF parameter encoding
 type storageLayout struct {
-	nonce []byte
-	value []byte
+	version    int
+	kdf        string
+	params     KDFParams
+	salt       []byte
+	wrappedKey []byte
+	suite      string
+	nonce      []byte
+	value      []byte
+}
+
+// layoutDecoder fills a storageLayout from the parts following the version marker
+type layoutDecoder func(sl *storageLayout, parts [][]byte) error
+
+// layoutDecoders holds the decoder for every storageLayout version we can read.
+// New versions are added here, old versions must never be removed.
+var layoutDecoders = map[int]layoutDecoder{
+	0: decodeV0,
+	1: decodeV1,
+	2: decodeV2,
+	3: decodeV2,
+	4: decodeV4,
 }
 
 // Encode will take the values within a storageLayout and output a ready to store
-// byte slice. It will validate that values have been filled.
+// byte slice in the current version for its key source. It will validate that
+// values have been filled.
 func (sl storageLayout) Encode() ([]byte, error) {
-	if len(sl.nonce) == 0 {
+	if sl.suite != CipherAES256GCM {
 		return []byte{}, ErrStorageLayoutEncodingInput
 	}
 
-	if len(sl.value) == 0 {
+	if len(sl.nonce) == 0 {
 		return []byte{}, ErrStorageLayoutEncodingInput
 	}
 
-	delimiter := []byte(storageDelimiter)
-	buffer := new(bytes.Buffer)
-	// base64 encode it so we don't overlap our delimiters
-	nonceEncoder := base64.NewEncoder(base64EncodingType, buffer)
-	// append on the nonce value - <nonce>
-	_, err := nonceEncoder.Write(sl.nonce) // write through the encoder to the buffer
-	if err != nil {
+	if len(sl.value) == 0 {
 		return []byte{}, ErrStorageLayoutEncodingInput
 	}
 
-	err = nonceEncoder.Close() // close it so everything flushes
-	if err != nil {
-		return []byte{}, ErrStorageLayoutEncodingInput
-	}
-	// append on the third delimiter - <nonce><delimiter>
-	_, err = buffer.Write(delimiter)
-	if err != nil {
-		return []byte{}, ErrStorageLayoutEncodingInput
-	}
-	// base64 encode it so we don't overlap our delimiters
-	valueEncoder := base64.NewEncoder(base64EncodingType, buffer)
-	// append on the ciphertext value - <nonce><delimiter><value>
-	_, err = valueEncoder.Write(sl.value) // write through the encoder to the buffer
-	if err != nil {
-		return []byte{}, ErrStorageLayoutEncodingInput
-	}
+	var fields []string
+	// <version><d><key source><d><salt or wrapped key><d><suite>
+	switch sl.kdf {
+	case KDFArgon2id:
+		if sl.params.Validate() != nil || len(sl.salt) == 0 {
+			return []byte{}, ErrStorageLayoutEncodingInput
+		}
 
-	err = valueEncoder.Close() // close it so everything flushes
-	if err != nil {
+		fields = []string{
+			versionPrefix + strconv.Itoa(passphraseLayoutVersion),
+			sl.params.String(),
+			base64EncodingType.EncodeToString(sl.salt),
+			sl.suite,
+		}
+	case KeyMasterKey:
+		if len(sl.wrappedKey) == 0 {
+			return []byte{}, ErrStorageLayoutEncodingInput
+		}
+
+		fields = []string{
+			versionPrefix + strconv.Itoa(masterKeyLayoutVersion),
+			KeyMasterKey,
+			base64EncodingType.EncodeToString(sl.wrappedKey),
+			sl.suite,
+		}
+	default:
 		return []byte{}, ErrStorageLayoutEncodingInput
 	}
+	// base64 encode the rest so we don't overlap our delimiters - <...><d><nonce><d><value>
+	fields = append(fields,
+		base64EncodingType.EncodeToString(sl.nonce),
+		base64EncodingType.EncodeToString(sl.value),
+	)
 
-	return buffer.Bytes(), nil
+	return []byte(strings.Join(fields, storageDelimiter)), nil
 }
 
-// Decode will take a byte slice in the storageLayout format and marshal it
+// Decode will take a byte slice in any known storageLayout version and marshal it
 // into a storageLayout struct to be accessed with the accessor methods
 func (sl *storageLayout) Decode(b []byte) error {
 	// ensure we didn't get an empty array
@@ -95,32 +138,189 @@ func (sl *storageLayout) Decode(b []byte) error {
 	// split it based on the delimiter, if we change this for a system in
 	// production and update....we are going to have a bad time.
 	parts := bytes.Split(b, []byte(storageDelimiter))
-	// check that we ONLY get 2 parts, more or less is an error
+
+	version, parts, err := layoutVersion(parts)
+	if err != nil {
+		return err
+	}
+
+	decoder, ok := layoutDecoders[version]
+	if !ok {
+		return ErrStorageLayoutDecoding(fmt.Sprintf("unknown layout version %d", version))
+	}
+
+	sl.version = version
+
+	return decoder(sl, parts)
+}
+
+// layoutVersion works out the version of the split storageLayout and returns
+// the parts that follow the version marker. The unversioned layouts written
+// before the envelope existed are told apart by their number of parts. A legacy
+// base64 nonce may start with the version prefix, so it must also be numeric.
+func layoutVersion(parts [][]byte) (int, [][]byte, error) {
+	first := string(parts[0])
+	if strings.HasPrefix(first, versionPrefix) {
+		version, err := strconv.Atoi(strings.TrimPrefix(first, versionPrefix))
+		if err == nil && version >= 0 {
+			return version, parts[1:], nil
+		}
+	}
+
+	switch len(parts) {
+	case 2:
+		return 0, parts, nil
+	case 4:
+		return 1, parts, nil
+	default:
+		return 0, nil, ErrStorageLayoutDecodingInput
+	}
+}
+
+// decodeV0 reads the original layout - <nonce><d><value> - keyed by a single SHA-256
+func decodeV0(sl *storageLayout, parts [][]byte) error {
 	if len(parts) != 2 {
 		return ErrStorageLayoutDecodingInput
 	}
-	// make a temp slice to read things into
-	nonceBuf := make([]byte, base64EncodingType.DecodedLen(len(parts[nonceIndex])))
-	// decode the base64 slice into the nonce array - don't care about number of bytes
-	_, err := base64EncodingType.Decode(nonceBuf, parts[nonceIndex])
-	if err != nil {
-		return ErrStorageLayoutDecoding(err.Error())
+
+	sl.kdf = KDFSHA256
+	sl.params = KDFParams{}
+	sl.salt = nil
+	sl.suite = CipherAES256GCM
+
+	return sl.decodeNonceAndValue(parts[0], parts[1])
+}
+
+// decodeV1 reads the unversioned salted layout - <kdf><d><salt><d><nonce><d><value>
+func decodeV1(sl *storageLayout, parts [][]byte) error {
+	if len(parts) != 4 {
+		return ErrStorageLayoutDecodingInput
 	}
 
-	sl.nonce = nonceBuf
-	// make a temp slice to read things into
-	valueBuf := make([]byte, base64EncodingType.DecodedLen(len(parts[valueIndex])))
+	if err := sl.decodeKDF(parts[0], parts[1]); err != nil {
+		return err
+	}
+
+	sl.suite = CipherAES256GCM
+
+	return sl.decodeNonceAndValue(parts[2], parts[3])
+}
+
+// decodeV2 reads the versioned envelope used by v2 and v3 - <kdf><d><salt><d><suite><d><nonce><d><value>
+func decodeV2(sl *storageLayout, parts [][]byte) error {
+	if len(parts) != 5 {
+		return ErrStorageLayoutDecodingInput
+	}
+
+	if err := sl.decodeKDF(parts[0], parts[1]); err != nil {
+		return err
+	}
+
+	sl.suite = string(parts[2])
+
+	return sl.decodeNonceAndValue(parts[3], parts[4])
+}
+
+// decodeV4 reads the master key envelope - masterkey<d><wrapped key><d><suite><d><nonce><d><value>
+func decodeV4(sl *storageLayout, parts [][]byte) error {
+	if len(parts) != 5 || string(parts[0]) != KeyMasterKey {
+		return ErrStorageLayoutDecodingInput
+	}
+
+	var err error
+
+	sl.kdf = KeyMasterKey
+	sl.params = KDFParams{}
+	sl.salt = nil
 
-	_, err = base64EncodingType.Decode(valueBuf, parts[valueIndex])
+	if sl.wrappedKey, err = decodePart(parts[1]); err != nil {
+		return err
+	}
+
+	sl.suite = string(parts[2])
+
+	return sl.decodeNonceAndValue(parts[3], parts[4])
+}
+
+// decodeKDF reads the KDF id, parameters and salt parts
+func (sl *storageLayout) decodeKDF(kdf []byte, salt []byte) error {
+	var err error
+
+	sl.kdf, sl.params, err = parseKDF(string(kdf))
 	if err != nil {
 		return ErrStorageLayoutDecoding(err.Error())
 	}
 
-	sl.value = valueBuf
+	if sl.salt, err = decodePart(salt); err != nil {
+		return err
+	}
 
 	return nil
 }
 
+// decodeNonceAndValue reads the base64 nonce and ciphertext parts
+func (sl *storageLayout) decodeNonceAndValue(nonce []byte, value []byte) error {
+	var err error
+
+	if sl.nonce, err = decodePart(nonce); err != nil {
+		return err
+	}
+
+	if sl.value, err = decodePart(value); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// decodePart decodes a single base64 part of the storageLayout
+func decodePart(part []byte) ([]byte, error) {
+	// make a temp slice to read things into
+	buf := make([]byte, base64EncodingType.DecodedLen(len(part)))
+	// decode the base64 slice into the array - don't care about number of bytes
+	_, err := base64EncodingType.Decode(buf, part)
+	if err != nil {
+		return nil, ErrStorageLayoutDecoding(err.Error())
+	}
+
+	return buf, nil
+}
+
+// Version will return the version the storageLayout was read from
+func (sl *storageLayout) Version() int {
+	return sl.version
+}
+
+// KDF will return the current stored KDF id
+func (sl *storageLayout) KDF() string {
+	return sl.kdf
+}
+
+// Params will return the current stored KDF parameters
+func (sl *storageLayout) Params() KDFParams {
+	return sl.params
+}
+
+// Salt will return the current stored Salt
+func (sl *storageLayout) Salt() []byte {
+	return sl.salt
+}
+
+// WrappedKey will return the current stored wrapped data key
+func (sl *storageLayout) WrappedKey() []byte {
+	return sl.wrappedKey
+}
+
+// BindsAdditionalData reports whether the value was sealed with additional data
+func (sl *storageLayout) BindsAdditionalData() bool {
+	return sl.version >= additionalDataLayoutVersion
+}
+
+// Suite will return the current stored cipher suite
+func (sl *storageLayout) Suite() string {
+	return sl.suite
+}
+
 // Value will return the current stored Value
 func (sl *storageLayout) Value() []byte {
 	return sl.value
@@ -0,0 +1,92 @@
+package daemon
+
+import (
+	"bufio"
+	"encoding/base64"
+	"errors"
+	"net"
+	"time"
+)
+
+// dialTimeout bounds how long we wait for a daemon before prompting instead
+const dialTimeout = time.Second
+
+// ErrNotRunning returns an error when no daemon is listening on the socket
+var ErrNotRunning = errors.New("daemon failure: not running")
+
+// Client talks to a running daemon over its unix socket
+type Client struct {
+	socket string
+}
+
+// NewClient creates a client for the daemon listening at the provided socket
+func NewClient(socket string) *Client {
+	return &Client{socket: socket}
+}
+
+// Get returns the cached secret for name, or an empty string if nothing is cached
+func (c *Client) Get(name string) (string, error) {
+	attrs, err := c.do(&request{
+		action: ActionGet,
+		attrs:  map[string]string{nameKey: name},
+	})
+	if err != nil {
+		return "", err
+	}
+
+	encoded, ok := attrs[secretKey]
+	if !ok {
+		return "", nil
+	}
+
+	secret, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", err
+	}
+
+	return string(secret), nil
+}
+
+// Store caches the secret for name until the daemon timeout passes
+func (c *Client) Store(name string, secret string) error {
+	_, err := c.do(&request{
+		action: ActionStore,
+		attrs: map[string]string{
+			nameKey:   name,
+			secretKey: base64.StdEncoding.EncodeToString([]byte(secret)),
+		},
+	})
+
+	return err
+}
+
+// Forget drops every cached secret
+func (c *Client) Forget() error {
+	_, err := c.do(&request{action: ActionForget})
+	return err
+}
+
+// Exit stops the daemon
+func (c *Client) Exit() error {
+	_, err := c.do(&request{action: ActionExit})
+	return err
+}
+
+func (c *Client) do(req *request) (map[string]string, error) {
+	conn, err := net.DialTimeout("unix", c.socket, dialTimeout)
+	if err != nil {
+		return nil, ErrNotRunning
+	}
+	defer conn.Close()
+
+	err = conn.SetDeadline(time.Now().Add(connectionDeadline))
+	if err != nil {
+		return nil, err
+	}
+
+	if err := writeRequest(conn, req); err != nil {
+		return nil, err
+	}
+
+	return readAttrs(bufio.NewReader(conn))
+}
@@ -0,0 +1,98 @@
+// Package daemon caches unlocked keys in memory behind a per-user unix socket
+package daemon
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+)
+
+const (
+	// ActionGet asks the daemon for a cached secret
+	ActionGet = "get"
+	// ActionStore hands a secret to the daemon to cache
+	ActionStore = "store"
+	// ActionForget drops every cached secret
+	ActionForget = "forget"
+	// ActionExit stops the daemon
+	ActionExit = "exit"
+
+	nameKey   = "name"
+	secretKey = "secret"
+)
+
+// request is a single action sent over the socket. The wire format follows the
+// git credential protocol: an action line, key=value lines and an empty line.
+type request struct {
+	action string
+	attrs  map[string]string
+}
+
+func writeRequest(w io.Writer, req *request) error {
+	if _, err := fmt.Fprintf(w, "%s\n", req.action); err != nil {
+		return err
+	}
+
+	return writeAttrs(w, req.attrs)
+}
+
+func readRequest(r *bufio.Reader) (*request, error) {
+	action, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+
+	attrs, err := readAttrs(r)
+	if err != nil {
+		return nil, err
+	}
+
+	return &request{
+		action: strings.TrimSuffix(action, "\n"),
+		attrs:  attrs,
+	}, nil
+}
+
+func writeAttrs(w io.Writer, attrs map[string]string) error {
+	for key, value := range attrs {
+		if strings.ContainsAny(key+value, "\n\x00") || strings.Contains(key, "=") {
+			return fmt.Errorf("invalid attribute %q", key)
+		}
+
+		if _, err := fmt.Fprintf(w, "%s=%s\n", key, value); err != nil {
+			return err
+		}
+	}
+
+	_, err := fmt.Fprint(w, "\n")
+	return err
+}
+
+func readAttrs(r *bufio.Reader) (map[string]string, error) {
+	attrs := make(map[string]string)
+
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			// a closed connection ends the attributes as well
+			if err == io.EOF && line == "" {
+				return attrs, nil
+			}
+
+			return nil, err
+		}
+
+		line = strings.TrimSuffix(line, "\n")
+		if line == "" {
+			return attrs, nil
+		}
+
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid input string")
+		}
+
+		attrs[parts[0]] = parts[1]
+	}
+}
@@ -0,0 +1,241 @@
+package daemon
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	// DefaultTimeout is how long a secret is cached, matching git-credential-cache
+	DefaultTimeout = 900 * time.Second
+	// connectionDeadline bounds how long a single client may hold a connection
+	connectionDeadline = 5 * time.Second
+)
+
+// ErrAlreadyRunning returns an error when another daemon is serving the socket
+var ErrAlreadyRunning = errors.New("daemon failure: already running")
+
+// ErrInsecureSocketDirectory returns an error when others could reach the
+// socket through its directory
+var ErrInsecureSocketDirectory = errors.New("daemon failure: insecure socket directory")
+
+type cacheEntry struct {
+	secret  string
+	expires time.Time
+}
+
+// Server holds unlocked secrets in memory until they time out
+type Server struct {
+	socket  string
+	timeout time.Duration
+
+	mu      sync.Mutex
+	entries map[string]*cacheEntry
+
+	listener  net.Listener
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// NewServer creates a daemon serving the unix socket at the provided path
+func NewServer(socket string, timeout time.Duration) *Server {
+	return &Server{
+		socket:  socket,
+		timeout: timeout,
+		entries: make(map[string]*cacheEntry),
+		done:    make(chan struct{}),
+	}
+}
+
+// Serve listens on the socket and answers requests until an exit is received
+func (s *Server) Serve() error {
+	if err := s.listen(); err != nil {
+		return err
+	}
+	defer os.Remove(s.socket)
+
+	go s.expireLoop()
+
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			select {
+			case <-s.done:
+				return nil
+			default:
+				return err
+			}
+		}
+
+		go s.handle(conn)
+	}
+}
+
+func (s *Server) listen() error {
+	// the socket directory keeps other users from connecting at all
+	if err := os.MkdirAll(filepath.Dir(s.socket), 0700); err != nil {
+		return err
+	}
+
+	if err := checkSocketDirectory(filepath.Dir(s.socket)); err != nil {
+		return err
+	}
+
+	if _, err := os.Stat(s.socket); err == nil {
+		// a socket we can still talk to belongs to a live daemon
+		if conn, err := net.Dial("unix", s.socket); err == nil {
+			conn.Close()
+			return ErrAlreadyRunning
+		}
+		// otherwise it is left over from a daemon that died
+		if err := os.Remove(s.socket); err != nil {
+			return err
+		}
+	}
+
+	listener, err := net.Listen("unix", s.socket)
+	if err != nil {
+		return err
+	}
+
+	if err := os.Chmod(s.socket, 0600); err != nil {
+		listener.Close()
+		return err
+	}
+
+	s.listener = listener
+
+	return nil
+}
+
+// checkSocketDirectory refuses a socket directory with a mode other than 0700
+// or that belongs to another user, like git-credential-cache
+func checkSocketDirectory(dir string) error {
+	info, err := os.Lstat(dir)
+	if err != nil {
+		return err
+	}
+
+	if !info.IsDir() {
+		return fmt.Errorf("%w: %s is not a directory", ErrInsecureSocketDirectory, dir)
+	}
+
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok && int(stat.Uid) != os.Getuid() {
+		return fmt.Errorf("%w: %s is owned by uid %d, not by you", ErrInsecureSocketDirectory, dir, stat.Uid)
+	}
+
+	if perm := info.Mode().Perm(); perm != 0700 {
+		return fmt.Errorf("%w: %s has mode %04o, run chmod 700 %s", ErrInsecureSocketDirectory, dir, perm, dir)
+	}
+
+	return nil
+}
+
+func (s *Server) handle(conn net.Conn) {
+	defer conn.Close()
+
+	err := conn.SetDeadline(time.Now().Add(connectionDeadline))
+	if err != nil {
+		return
+	}
+
+	req, err := readRequest(bufio.NewReader(conn))
+	if err != nil {
+		return
+	}
+
+	switch req.action {
+	case ActionGet:
+		attrs := make(map[string]string)
+		if secret, ok := s.get(req.attrs[nameKey]); ok {
+			attrs[secretKey] = secret
+		}
+
+		_ = writeAttrs(conn, attrs)
+	case ActionStore:
+		s.store(req.attrs[nameKey], req.attrs[secretKey])
+		_ = writeAttrs(conn, nil)
+	case ActionForget:
+		s.forget()
+		_ = writeAttrs(conn, nil)
+	case ActionExit:
+		s.forget()
+		_ = writeAttrs(conn, nil)
+		s.shutdown()
+	default:
+		// ignore unknown actions
+	}
+}
+
+func (s *Server) get(name string) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry, ok := s.entries[name]
+	if !ok {
+		return "", false
+	}
+
+	if time.Now().After(entry.expires) {
+		delete(s.entries, name)
+		return "", false
+	}
+
+	return entry.secret, true
+}
+
+func (s *Server) store(name string, secret string) {
+	if name == "" || secret == "" {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.entries[name] = &cacheEntry{
+		secret:  secret,
+		expires: time.Now().Add(s.timeout),
+	}
+}
+
+func (s *Server) forget() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.entries = make(map[string]*cacheEntry)
+}
+
+func (s *Server) shutdown() {
+	s.closeOnce.Do(func() {
+		close(s.done)
+		s.listener.Close()
+	})
+}
+
+// expireLoop drops timed out secrets so they don't linger in memory
+func (s *Server) expireLoop() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case now := <-ticker.C:
+			s.mu.Lock()
+			for name, entry := range s.entries {
+				if now.After(entry.expires) {
+					delete(s.entries, name)
+				}
+			}
+			s.mu.Unlock()
+		}
+	}
+}
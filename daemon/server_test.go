@@ -0,0 +1,155 @@
+package daemon
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// startServer runs a daemon on a socket in a new directory until the returned
+// function is called, it waits for the daemon to answer first
+func startServer(t *testing.T, timeout time.Duration) (*Client, <-chan error, func()) {
+	dir, err := ioutil.TempDir("", "daemon")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	socket := filepath.Join(dir, "socket")
+	served := make(chan error, 1)
+	go func() {
+		served <- NewServer(socket, timeout).Serve()
+	}()
+
+	client := NewClient(socket)
+	stop := func() {
+		client.Exit()
+		os.RemoveAll(dir)
+	}
+
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if _, err := client.Get("ping"); err != ErrNotRunning {
+			break
+		}
+
+		select {
+		case err := <-served:
+			os.RemoveAll(dir)
+			t.Fatalf("the daemon stopped: %v", err)
+		default:
+		}
+
+		if time.Now().After(deadline) {
+			stop()
+			t.Fatal("the daemon didn't start")
+		}
+	}
+
+	return client, served, stop
+}
+
+func TestServer(t *testing.T) {
+	client, served, stop := startServer(t, DefaultTimeout)
+	defer stop()
+
+	if secret, err := client.Get("example"); err != nil || secret != "" {
+		t.Fatalf("an empty cache returned %q, %v", secret, err)
+	}
+
+	if err := client.Store("example", "secret"); err != nil {
+		t.Fatal(err)
+	}
+	if secret, err := client.Get("example"); err != nil || secret != "secret" {
+		t.Fatalf("got %q, %v after a store", secret, err)
+	}
+
+	if err := NewServer(client.socket, DefaultTimeout).Serve(); err != ErrAlreadyRunning {
+		t.Fatalf("a second daemon on the socket returned %v", err)
+	}
+
+	if err := client.Forget(); err != nil {
+		t.Fatal(err)
+	}
+	if secret, err := client.Get("example"); err != nil || secret != "" {
+		t.Fatalf("got %q, %v after a forget", secret, err)
+	}
+
+	if err := client.Store("example", "secret"); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Exit(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-served:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the daemon didn't exit")
+	}
+
+	if _, err := os.Stat(client.socket); !os.IsNotExist(err) {
+		t.Fatalf("the socket is left behind: %v", err)
+	}
+	if _, err := client.Get("example"); err != ErrNotRunning {
+		t.Fatalf("got %v from a daemon that exited", err)
+	}
+}
+
+func TestServerTimeout(t *testing.T) {
+	client, _, stop := startServer(t, 50*time.Millisecond)
+	defer stop()
+
+	if err := client.Store("example", "secret"); err != nil {
+		t.Fatal(err)
+	}
+	if secret, err := client.Get("example"); err != nil || secret != "secret" {
+		t.Fatalf("got %q, %v right after a store", secret, err)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	if secret, err := client.Get("example"); err != nil || secret != "" {
+		t.Fatalf("got %q, %v after the timeout", secret, err)
+	}
+}
+
+func TestServerRefusesInsecureDirectory(t *testing.T) {
+	tests := map[string]func(t *testing.T, dir string) error{
+		"mode 0755": func(t *testing.T, dir string) error {
+			return os.Chmod(dir, 0755)
+		},
+		"foreign owner": func(t *testing.T, dir string) error {
+			if os.Getuid() != 0 {
+				t.Skip("changing the owner needs root")
+			}
+
+			return os.Chown(dir, 1, 1)
+		},
+	}
+
+	for name, prepare := range tests {
+		t.Run(name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "daemon")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			if err := prepare(t, dir); err != nil {
+				t.Fatal(err)
+			}
+
+			socket := filepath.Join(dir, "socket")
+			err = NewServer(socket, DefaultTimeout).Serve()
+			if !errors.Is(err, ErrInsecureSocketDirectory) {
+				t.Fatalf("served from an insecure directory: %v", err)
+			}
+			if _, err := os.Stat(socket); !os.IsNotExist(err) {
+				t.Fatalf("created a socket: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,32 @@
+package dialogs
+
+import (
+	"os/exec"
+	"strings"
+)
+
+// askpass runs an askpass program such as GIT_ASKPASS or SSH_ASKPASS, which
+// takes the prompt as its only argument and prints the answer
+type askpass struct {
+	program string
+}
+
+// PasswordBox runs the askpass program once, returning the entered value
+func (a *askpass) PasswordBox(user string) (string, error) {
+	return a.ask(passwordPrompt(user))
+}
+
+// PasswordCreationBox runs the askpass program twice to confirm the value.
+// Askpass programs can't show errors, so a mismatch just starts over.
+func (a *askpass) PasswordCreationBox(user string) (string, error) {
+	return confirmPassword(a.ask, func() error { return nil }, user)
+}
+
+func (a *askpass) ask(prompt string) (string, error) {
+	out, err := exec.Command(a.program, prompt+": ").Output()
+	if err != nil {
+		return "", ErrPasswordFailure
+	}
+
+	return strings.TrimSuffix(string(out), "\n"), nil
+}
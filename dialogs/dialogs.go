@@ -0,0 +1,205 @@
+// Package dialogs asks the user for passphrases through a pluggable Prompter
+package dialogs
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+)
+
+const (
+	// PrompterAuto picks the best prompter for the current environment
+	PrompterAuto = "auto"
+	// PrompterZenity shows GTK dialogs with zenity
+	PrompterZenity = "zenity"
+	// PrompterKDialog shows KDE dialogs with kdialog
+	PrompterKDialog = "kdialog"
+	// PrompterPinentry talks the Assuan protocol to a pinentry program
+	PrompterPinentry = "pinentry"
+	// PrompterAskpass runs the program in GIT_ASKPASS or SSH_ASKPASS
+	PrompterAskpass = "askpass"
+	// PrompterTTY prompts on the controlling terminal with echo disabled
+	PrompterTTY = "tty"
+)
+
+var (
+	// ErrPasswordFailure returns an error when no password could be read from the user
+	ErrPasswordFailure = errors.New("failure to get user password")
+	// ErrNoPrompter returns an error when no prompter works in the current environment
+	ErrNoPrompter = errors.New("no usable password prompt: no display, askpass program or terminal")
+	// ErrCancelled returns an error when the user cancelled the prompt
+	ErrCancelled = errors.New("password prompt cancelled")
+)
+
+// Prompter asks the user for passphrases
+type Prompter interface {
+	// PasswordBox asks for an existing passphrase
+	PasswordBox(user string) (string, error)
+	// PasswordCreationBox asks for a new passphrase with confirmation. It only
+	// returns once the user entered matching passphrases or cancelled.
+	PasswordCreationBox(user string) (string, error)
+}
+
+// current is the prompter used by the package level functions
+var current Prompter
+
+// PasswordBox asks for an existing passphrase with the selected prompter
+func PasswordBox(user string) (string, error) {
+	p, err := selected()
+	if err != nil {
+		return "", err
+	}
+
+	return p.PasswordBox(user)
+}
+
+// PasswordCreationBox asks for a new passphrase with the selected prompter
+func PasswordCreationBox(user string) (string, error) {
+	p, err := selected()
+	if err != nil {
+		return "", err
+	}
+
+	return p.PasswordCreationBox(user)
+}
+
+// Select makes the named prompter the one used by PasswordBox and PasswordCreationBox
+func Select(name string) error {
+	p, err := New(name)
+	if err != nil {
+		return err
+	}
+
+	Use(p)
+
+	return nil
+}
+
+// Use makes p the prompter used by PasswordBox and PasswordCreationBox
+func Use(p Prompter) {
+	current = p
+}
+
+// New creates the named prompter. PrompterAuto, or an empty name, picks one
+// for the current environment.
+func New(name string) (Prompter, error) {
+	switch name {
+	case PrompterAuto, "":
+		return detect()
+	case PrompterZenity:
+		return &zenity{}, nil
+	case PrompterKDialog:
+		return &kdialog{}, nil
+	case PrompterPinentry:
+		return NewPinentry(PrompterPinentry), nil
+	case PrompterAskpass:
+		program := askpassProgram()
+		if program == "" {
+			return nil, fmt.Errorf("neither GIT_ASKPASS nor SSH_ASKPASS is set")
+		}
+
+		return &askpass{program: program}, nil
+	case PrompterTTY:
+		return &tty{}, nil
+	default:
+		return nil, fmt.Errorf("unknown prompter %q", name)
+	}
+}
+
+func selected() (Prompter, error) {
+	if current != nil {
+		return current, nil
+	}
+
+	p, err := detect()
+	if err != nil {
+		return nil, err
+	}
+
+	current = p
+
+	return current, nil
+}
+
+// detect prefers graphical dialogs when there is a display, then an askpass
+// program, which is what git itself would use, and finally the terminal
+func detect() (Prompter, error) {
+	if hasDisplay() {
+		if onPath(PrompterZenity) {
+			return &zenity{}, nil
+		}
+
+		if onPath(PrompterKDialog) {
+			return &kdialog{}, nil
+		}
+	}
+
+	if program := askpassProgram(); program != "" {
+		return &askpass{program: program}, nil
+	}
+
+	if hasTTY() {
+		return &tty{}, nil
+	}
+
+	return nil, ErrNoPrompter
+}
+
+func hasDisplay() bool {
+	return os.Getenv("DISPLAY") != "" || os.Getenv("WAYLAND_DISPLAY") != ""
+}
+
+func onPath(program string) bool {
+	_, err := exec.LookPath(program)
+	return err == nil
+}
+
+// askpassProgram follows the order git uses to find an askpass program
+func askpassProgram() string {
+	for _, env := range []string{"GIT_ASKPASS", "SSH_ASKPASS"} {
+		if program := os.Getenv(env); program != "" {
+			return program
+		}
+	}
+
+	return ""
+}
+
+// confirmPassword asks twice until both answers match, reporting each mismatch
+func confirmPassword(ask func(prompt string) (string, error), mismatch func() error, user string) (string, error) {
+	for {
+		password, err := ask(creationPrompt(user))
+		if err != nil {
+			return "", err
+		}
+
+		confirmation, err := ask(confirmationPrompt(user))
+		if err != nil {
+			return "", err
+		}
+
+		if password == confirmation {
+			return password, nil
+		}
+
+		if err := mismatch(); err != nil {
+			return "", err
+		}
+	}
+}
+
+// passwordPrompt is the text shown when asking for an existing passphrase
+func passwordPrompt(user string) string {
+	return fmt.Sprintf("Please enter the decryption password for %s", user)
+}
+
+// creationPrompt is the text shown when asking for a new passphrase
+func creationPrompt(user string) string {
+	return fmt.Sprintf("Please create a localized passphrase to encrypt/decrypt local password for %s", user)
+}
+
+// confirmationPrompt is the text shown when confirming a new passphrase
+func confirmationPrompt(user string) string {
+	return fmt.Sprintf("Please confirm the passphrase for %s", user)
+}
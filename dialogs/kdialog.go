@@ -0,0 +1,36 @@
+package dialogs
+
+import (
+	"os/exec"
+	"strings"
+)
+
+// kdialog shows KDE dialogs
+type kdialog struct{}
+
+// PasswordBox displays a password dialog, returning the entered value
+func (k *kdialog) PasswordBox(user string) (string, error) {
+	out, err := exec.Command("kdialog",
+		"--title", "Decryption Password",
+		"--password", passwordPrompt(user)).Output()
+	// NOTE: exit code 1 = cancel was pressed
+	if err != nil {
+		return "", ErrPasswordFailure
+	}
+
+	return strings.TrimSuffix(string(out), "\n"), nil
+}
+
+// PasswordCreationBox displays kdialog's new password dialog, which does the
+// confirmation itself and only returns matching passwords or a cancel
+func (k *kdialog) PasswordCreationBox(user string) (string, error) {
+	out, err := exec.Command("kdialog",
+		"--title", "Encryption Password Creation",
+		"--newpassword", creationPrompt(user)).Output()
+	// NOTE: exit code 1 = cancel was pressed
+	if err != nil {
+		return "", ErrPasswordFailure
+	}
+
+	return strings.TrimSuffix(string(out), "\n"), nil
+}
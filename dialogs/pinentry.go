@@ -0,0 +1,272 @@
+package dialogs
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+const (
+	// pinentryTitle is the window title of every pinentry prompt
+	pinentryTitle = "git-credential-crypt-store"
+	// pinentryMismatch is shown when the confirmation doesn't match
+	pinentryMismatch = "Passwords Do Not Match"
+	// statusPinRepeated is sent by a pinentry that did the confirmation itself
+	statusPinRepeated = "PIN_REPEATED"
+
+	// gpgErrCanceled and gpgErrFullyCanceled are the gpg-error codes for a
+	// cancelled prompt, assuanErrCanceled is what very old pinentries send
+	gpgErrCanceled      = 99
+	gpgErrFullyCanceled = 198
+	assuanErrCanceled   = 111
+	// gpgErrCodeMask strips the error source from a gpg-error value
+	gpgErrCodeMask = 0xFFFF
+)
+
+// pinentry talks the Assuan protocol to a pinentry program, the same prompts
+// gpg-agent uses
+type pinentry struct {
+	program string
+}
+
+// NewPinentry creates a prompter running the provided pinentry program, e.g.
+// pinentry-curses, pinentry-gnome3, pinentry-tty or a path to one
+func NewPinentry(program string) Prompter {
+	return &pinentry{program: program}
+}
+
+// PasswordBox asks pinentry for a password
+func (p *pinentry) PasswordBox(user string) (string, error) {
+	session, err := p.start(passwordPrompt(user))
+	if err != nil {
+		return "", err
+	}
+	defer session.close()
+
+	pin, _, err := session.transact("GETPIN")
+
+	return pin, err
+}
+
+// PasswordCreationBox asks pinentry for a new password with confirmation. A
+// pinentry that supports SETREPEAT confirms it itself, for older ones we ask
+// again and show the mismatch with SETERROR.
+func (p *pinentry) PasswordCreationBox(user string) (string, error) {
+	session, err := p.start(creationPrompt(user))
+	if err != nil {
+		return "", err
+	}
+	defer session.close()
+
+	if _, _, err := session.transact("SETREPEAT " + assuanEscape(confirmationPrompt(user))); err == nil {
+		// not every pinentry knows about a custom error text, the default is fine
+		_, _, _ = session.transact("SETREPEATERROR " + assuanEscape(pinentryMismatch))
+
+		pin, status, err := session.transact("GETPIN")
+		if err != nil {
+			return "", err
+		}
+
+		if hasStatus(status, statusPinRepeated) {
+			return pin, nil
+		}
+		// the pinentry accepted SETREPEAT but didn't confirm, so confirm it here
+		return p.confirm(session, user, pin)
+	}
+
+	pin, _, err := session.transact("GETPIN")
+	if err != nil {
+		return "", err
+	}
+
+	return p.confirm(session, user, pin)
+}
+
+// confirm asks for the password again until it matches, showing each mismatch
+func (p *pinentry) confirm(session *assuanSession, user string, pin string) (string, error) {
+	for {
+		if _, _, err := session.transact("SETDESC " + assuanEscape(confirmationPrompt(user))); err != nil {
+			return "", err
+		}
+
+		confirmation, _, err := session.transact("GETPIN")
+		if err != nil {
+			return "", err
+		}
+
+		if pin == confirmation {
+			return pin, nil
+		}
+		// start over, SETERROR is shown with the next GETPIN only
+		if _, _, err := session.transact("SETERROR " + assuanEscape(pinentryMismatch)); err != nil {
+			return "", err
+		}
+
+		if _, _, err := session.transact("SETDESC " + assuanEscape(creationPrompt(user))); err != nil {
+			return "", err
+		}
+
+		pin, _, err = session.transact("GETPIN")
+		if err != nil {
+			return "", err
+		}
+	}
+}
+
+// start runs the pinentry program and sets up the prompt texts
+func (p *pinentry) start(description string) (*assuanSession, error) {
+	session, err := startAssuan(p.program)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, cmd := range []string{
+		"SETTITLE " + assuanEscape(pinentryTitle),
+		"SETDESC " + assuanEscape(description),
+		"SETPROMPT " + assuanEscape("Passphrase:"),
+	} {
+		if _, _, err := session.transact(cmd); err != nil {
+			session.close()
+			return nil, err
+		}
+	}
+
+	return session, nil
+}
+
+// assuanSession is a running pinentry program
+type assuanSession struct {
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	stdout *bufio.Reader
+}
+
+func startAssuan(program string) (*assuanSession, error) {
+	cmd := exec.Command(program)
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, ErrPasswordFailure
+	}
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, ErrPasswordFailure
+	}
+
+	if err := cmd.Start(); err != nil {
+		return nil, ErrPasswordFailure
+	}
+
+	s := &assuanSession{
+		cmd:    cmd,
+		stdin:  stdin,
+		stdout: bufio.NewReader(stdout),
+	}
+	// the server greets us with an OK once it is ready
+	if _, _, err := s.response(); err != nil {
+		s.close()
+		return nil, err
+	}
+	// curses and tty pinentries need to know where to draw, our stdio belongs to git
+	if hasTTY() {
+		if _, _, err := s.transact("OPTION ttyname=" + ttyPath); err != nil {
+			s.close()
+			return nil, err
+		}
+
+		if term := os.Getenv("TERM"); term != "" {
+			if _, _, err := s.transact("OPTION ttytype=" + term); err != nil {
+				s.close()
+				return nil, err
+			}
+		}
+	}
+
+	return s, nil
+}
+
+// transact sends a command and returns any data and status lines sent back
+// before the final OK
+func (s *assuanSession) transact(cmd string) (string, []string, error) {
+	if _, err := fmt.Fprintf(s.stdin, "%s\n", cmd); err != nil {
+		return "", nil, ErrPasswordFailure
+	}
+
+	return s.response()
+}
+
+// response reads lines until an OK or ERR, collecting the data and status lines
+func (s *assuanSession) response() (string, []string, error) {
+	var data strings.Builder
+	var status []string
+
+	for {
+		line, err := s.stdout.ReadString('\n')
+		if err != nil {
+			return "", nil, ErrPasswordFailure
+		}
+
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case line == "OK" || strings.HasPrefix(line, "OK "):
+			return data.String(), status, nil
+		case strings.HasPrefix(line, "ERR "):
+			return "", nil, assuanError(strings.TrimPrefix(line, "ERR "))
+		case strings.HasPrefix(line, "D "):
+			decoded, err := url.PathUnescape(strings.TrimPrefix(line, "D "))
+			if err != nil {
+				return "", nil, ErrPasswordFailure
+			}
+
+			data.WriteString(decoded)
+		case strings.HasPrefix(line, "S "):
+			status = append(status, strings.TrimPrefix(line, "S "))
+		default:
+			// ignore comment and inquiry lines
+		}
+	}
+}
+
+func (s *assuanSession) close() {
+	// best effort, the program exits once its input is closed anyway
+	_, _ = fmt.Fprintln(s.stdin, "BYE")
+	s.stdin.Close()
+	_ = s.cmd.Wait()
+}
+
+// assuanError turns the text after ERR into an error, telling cancels apart
+func assuanError(text string) error {
+	fields := strings.SplitN(text, " ", 2)
+
+	code, err := strconv.ParseUint(fields[0], 10, 32)
+	if err == nil {
+		switch code & gpgErrCodeMask {
+		case gpgErrCanceled, gpgErrFullyCanceled, assuanErrCanceled:
+			return ErrCancelled
+		}
+	}
+
+	return fmt.Errorf("pinentry failure: %s", text)
+}
+
+// hasStatus reports whether a status line with the provided keyword was sent
+func hasStatus(status []string, keyword string) bool {
+	for _, line := range status {
+		if line == keyword || strings.HasPrefix(line, keyword+" ") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// assuanEscape percent-escapes the characters Assuan doesn't allow in a line
+func assuanEscape(s string) string {
+	return strings.NewReplacer("%", "%25", "\r", "%0D", "\n", "%0A").Replace(s)
+}
@@ -0,0 +1,143 @@
+package dialogs
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// fakePinentry writes a pinentry script that answers the nth GETPIN with the
+// nth of the responses, which must end with OK or be an ERR line. SETREPEAT is
+// only accepted when repeat is set. It returns the program and a function
+// reading back every command it got.
+func fakePinentry(t *testing.T, repeat bool, responses ...string) (string, func() []string) {
+	dir, err := ioutil.TempDir("", "pinentry")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	log := filepath.Join(dir, "commands")
+	setRepeat := `echo "ERR 536871187 Unknown IPC command"`
+	if repeat {
+		setRepeat = "echo OK"
+	}
+
+	var pins strings.Builder
+	for idx, response := range responses {
+		fmt.Fprintf(&pins, "    %d) printf '%%s\\n' '%s' ;;\n", idx+1, strings.Replace(response, "\n", "' '", -1))
+	}
+
+	script := fmt.Sprintf(`#!/bin/sh
+echo "OK Pleased to meet you"
+n=0
+while read -r line; do
+  echo "$line" >> %q
+  case "$line" in
+  SETREPEAT*) %s ;;
+  GETPIN)
+    n=$((n+1))
+    case $n in
+%s    *) echo "ERR 83886142 no more pins" ;;
+    esac ;;
+  BYE) echo OK; exit 0 ;;
+  *) echo OK ;;
+  esac
+done
+`, log, setRepeat, pins.String())
+
+	program := filepath.Join(dir, "pinentry")
+	if err := ioutil.WriteFile(program, []byte(script), 0700); err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+
+	return program, func() []string {
+		defer os.RemoveAll(dir)
+
+		data, err := ioutil.ReadFile(log)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return strings.Split(strings.TrimSpace(string(data)), "\n")
+	}
+}
+
+// commandsStartingWith returns the commands with the provided prefix
+func commandsStartingWith(commands []string, prefix string) []string {
+	var ret []string
+	for _, cmd := range commands {
+		if strings.HasPrefix(cmd, prefix) {
+			ret = append(ret, cmd)
+		}
+	}
+
+	return ret
+}
+
+func TestPinentryRepeat(t *testing.T) {
+	program, commands := fakePinentry(t, true, "S PIN_REPEATED\nD secret\nOK")
+
+	pin, err := NewPinentry(program).PasswordCreationBox("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pin != "secret" {
+		t.Fatalf("got %q", pin)
+	}
+
+	got := commands()
+	if len(commandsStartingWith(got, "GETPIN")) != 1 || len(commandsStartingWith(got, "SETERROR")) != 0 {
+		t.Fatalf("a pinentry confirming itself was sent %q", got)
+	}
+}
+
+func TestPinentryConfirmsWithoutRepeat(t *testing.T) {
+	program, commands := fakePinentry(t, false,
+		"D first\nOK",
+		"D typo\nOK",
+		"D second\nOK",
+		"D second\nOK",
+	)
+
+	pin, err := NewPinentry(program).PasswordCreationBox("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pin != "second" {
+		t.Fatalf("got %q", pin)
+	}
+
+	got := commands()
+	if len(commandsStartingWith(got, "GETPIN")) != 4 {
+		t.Fatalf("expected 4 prompts, sent %q", got)
+	}
+	if seterror := commandsStartingWith(got, "SETERROR"); len(seterror) != 1 || seterror[0] != "SETERROR "+pinentryMismatch {
+		t.Fatalf("the mismatch was shown with %q", seterror)
+	}
+}
+
+func TestPinentryUnescapesData(t *testing.T) {
+	program, commands := fakePinentry(t, false, "D 100%25 sure%0Aof it\nOK")
+	defer commands()
+
+	pin, err := NewPinentry(program).PasswordBox("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pin != "100% sure\nof it" {
+		t.Fatalf("got %q", pin)
+	}
+}
+
+func TestPinentryCancel(t *testing.T) {
+	program, commands := fakePinentry(t, false, "ERR 83886179 Operation cancelled <Pinentry>")
+	defer commands()
+
+	if _, err := NewPinentry(program).PasswordBox("alice"); err != ErrCancelled {
+		t.Fatalf("cancelling gave %v", err)
+	}
+}
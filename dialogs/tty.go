@@ -0,0 +1,67 @@
+package dialogs
+
+import (
+	"fmt"
+	"os"
+
+	"golang.org/x/term"
+)
+
+// ttyPath is the controlling terminal, stdin and stdout belong to git
+const ttyPath = "/dev/tty"
+
+// tty prompts on the controlling terminal with echo disabled
+type tty struct{}
+
+// PasswordBox reads a password from the terminal
+func (t *tty) PasswordBox(user string) (string, error) {
+	return t.ask(passwordPrompt(user))
+}
+
+// PasswordCreationBox reads a password twice from the terminal until both match
+func (t *tty) PasswordCreationBox(user string) (string, error) {
+	return confirmPassword(t.ask, t.mismatch, user)
+}
+
+func (t *tty) ask(prompt string) (string, error) {
+	f, err := os.OpenFile(ttyPath, os.O_RDWR, 0)
+	if err != nil {
+		return "", ErrPasswordFailure
+	}
+	defer f.Close()
+
+	if _, err := fmt.Fprintf(f, "%s: ", prompt); err != nil {
+		return "", ErrPasswordFailure
+	}
+
+	password, err := term.ReadPassword(int(f.Fd()))
+	// echo is off, so the newline the user typed never made it to the screen
+	fmt.Fprintln(f)
+	if err != nil {
+		return "", ErrPasswordFailure
+	}
+
+	return string(password), nil
+}
+
+func (t *tty) mismatch() error {
+	f, err := os.OpenFile(ttyPath, os.O_WRONLY, 0)
+	if err != nil {
+		return ErrPasswordFailure
+	}
+	defer f.Close()
+
+	_, err = fmt.Fprintln(f, "Passwords Do Not Match")
+	return err
+}
+
+// hasTTY reports whether there is a controlling terminal to prompt on
+func hasTTY() bool {
+	f, err := os.OpenFile(ttyPath, os.O_RDWR, 0)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	return term.IsTerminal(int(f.Fd()))
+}
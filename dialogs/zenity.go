@@ -1,21 +1,22 @@
 package dialogs
 
 import (
-	"fmt"
 	"os/exec"
 	"strings"
 )
 
+// zenity shows GTK dialogs
+type zenity struct{}
+
 // PasswordBox displays a dialog box, returning the entered value and a error
-func PasswordBox(user string) (string, error) {
-	promptText := fmt.Sprintf("Please enter the decryption password for %s", user)
+func (z *zenity) PasswordBox(user string) (string, error) {
 	out, err := exec.Command("zenity", "--entry",
 		"--title", "Decryption Password",
-		"--text", promptText,
+		"--text", passwordPrompt(user),
 		"--hide-text").Output()
 	// NOTE: exit code 1 = cancel was pressed
 	if err != nil {
-		return "", fmt.Errorf("failure to get user password")
+		return "", ErrPasswordFailure
 	}
 
 	return strings.TrimSpace(string(out)), nil
@@ -23,20 +24,22 @@ func PasswordBox(user string) (string, error) {
 
 // PasswordCreationBox displays a password box with confirmation.
 // This will only return if the user has entered matching passwords or hit the cancel box.
-func PasswordCreationBox(user string) (string, error) {
-	promptText := fmt.Sprintf("Please create a localized passphrase to encrypt/decrypt local password for %s", user)
-
+func (z *zenity) PasswordCreationBox(user string) (string, error) {
 	for {
 		out, err := exec.Command("zenity", "--forms", "--add-password", "Password",
 			"--add-password", "Confirm Password",
 			"--title", "Encryption Password Creation",
-			"--text", promptText).Output()
+			"--text", creationPrompt(user)).Output()
 		// NOTE: exit code 1 = cancel was pressed
 		if err != nil {
-			return "", fmt.Errorf("failure to get user password")
+			return "", ErrPasswordFailure
 		}
 
 		parts := strings.SplitN(string(out), "|", 2)
+		if len(parts) != 2 {
+			return "", ErrPasswordFailure
+		}
+
 		if strings.TrimSpace(parts[0]) != strings.TrimSpace(parts[1]) {
 			_, err = exec.Command(
 				"zenity",
@@ -45,7 +48,7 @@ func PasswordCreationBox(user string) (string, error) {
 				"Passwords Do Not Match",
 			).Output()
 			if err != nil {
-				return "", fmt.Errorf("failure to get user password")
+				return "", ErrPasswordFailure
 			}
 		} else {
 			return strings.TrimSpace(parts[0]), nil
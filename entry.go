@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bytes"
+	"time"
+
+	"github.com/king-jam/git-credential-crypt-store/backend"
+	"github.com/king-jam/git-credential-crypt-store/crypto"
+)
+
+// entryMetadata is the usage record kept with every stored credential. Entries
+// stored before it was introduced have zero values.
+type entryMetadata struct {
+	CreatedAt  time.Time
+	UpdatedAt  time.Time
+	LastUsedAt time.Time
+	UseCount   uint64
+}
+
+// recordUse counts a get that handed out the credential
+func (m *entryMetadata) recordUse(now time.Time) {
+	m.LastUsedAt = now
+	m.UseCount++
+}
+
+// credentialFromEntry returns the stored entry as a credential, its secrets are
+// still encrypted
+func credentialFromEntry(e backend.Entry) *Credential {
+	return &Credential{
+		entryID:           e.ID,
+		Protocol:          e.Protocol,
+		Host:              e.Host,
+		Path:              e.Path,
+		Username:          e.Username,
+		Password:          e.Password,
+		AuthType:          e.AuthType,
+		Credential:        e.Credential,
+		PasswordExpiryUTC: e.PasswordExpiryUTC,
+		OAuthRefreshToken: e.OAuthRefreshToken,
+		secretHash:        e.SecretHash,
+		refreshTokenHash:  e.RefreshTokenHash,
+		metadata: entryMetadata{
+			CreatedAt:  timeValue(e.CreatedAt),
+			UpdatedAt:  timeValue(e.UpdatedAt),
+			LastUsedAt: timeValue(e.LastUsedAt),
+			UseCount:   e.UseCount,
+		},
+	}
+}
+
+// storedEntry returns the entry we persist for c, its secrets must already be encrypted
+func storedEntry(c *Credential) backend.Entry {
+	return backend.Entry{
+		ID:                c.entryID,
+		Protocol:          c.Protocol,
+		Host:              c.Host,
+		Path:              c.Path,
+		Username:          c.Username,
+		Password:          c.Password,
+		AuthType:          c.AuthType,
+		Credential:        c.Credential,
+		PasswordExpiryUTC: c.PasswordExpiryUTC,
+		OAuthRefreshToken: c.OAuthRefreshToken,
+		SecretHash:        c.secretHash,
+		RefreshTokenHash:  c.refreshTokenHash,
+		CreatedAt:         optionalTime(c.metadata.CreatedAt),
+		UpdatedAt:         optionalTime(c.metadata.UpdatedAt),
+		LastUsedAt:        optionalTime(c.metadata.LastUsedAt),
+		UseCount:          c.metadata.UseCount,
+	}
+}
+
+// optionalTime leaves unknown times out of the stored and listed JSON
+func optionalTime(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+
+	utc := t.UTC().Truncate(time.Second)
+	return &utc
+}
+
+// timeValue is the reverse of optionalTime
+func timeValue(t *time.Time) time.Time {
+	if t == nil {
+		return time.Time{}
+	}
+
+	return *t
+}
+
+// secrets returns the fields of c that are stored encrypted and are set
+func (c *Credential) secrets() []*string {
+	var secrets []*string
+
+	for _, secret := range []*string{&c.Password, &c.Credential, &c.OAuthRefreshToken} {
+		if *secret != "" {
+			secrets = append(secrets, secret)
+		}
+	}
+
+	return secrets
+}
+
+// authSecret is the secret git authenticates with, the password or the
+// credential of an authtype
+func (c *Credential) authSecret() string {
+	if c.Password != "" {
+		return c.Password
+	}
+
+	return c.Credential
+}
+
+// hashSecret records the hashes of the plaintext secrets of c for erase and store
+func hashSecret(c *Credential) error {
+	hash, err := crypto.HashSecret([]byte(c.authSecret()))
+	if err != nil {
+		return err
+	}
+
+	c.secretHash = string(hash)
+	c.refreshTokenHash = ""
+	if c.OAuthRefreshToken == "" {
+		return nil
+	}
+
+	hash, err = crypto.HashSecret([]byte(c.OAuthRefreshToken))
+	if err != nil {
+		return err
+	}
+
+	c.refreshTokenHash = string(hash)
+	return nil
+}
+
+// unchangedBy reports whether storing the request would leave the stored c as
+// it is, the common case of git storing a credential it just got from us
+func (c *Credential) unchangedBy(request *Credential) (bool, error) {
+	if c.secretHash == "" || c.AuthType != request.AuthType || c.PasswordExpiryUTC != request.PasswordExpiryUTC {
+		return false, nil
+	}
+
+	if (c.refreshTokenHash == "") != (request.OAuthRefreshToken == "") {
+		return false, nil
+	}
+
+	same, err := crypto.VerifySecret([]byte(c.secretHash), []byte(request.authSecret()))
+	if err != nil || !same || c.refreshTokenHash == "" {
+		return same, err
+	}
+
+	return crypto.VerifySecret([]byte(c.refreshTokenHash), []byte(request.OAuthRefreshToken))
+}
+
+// usableBy reports whether the stored c can answer the request, an authtype
+// credential is only any use to a git that advertised the capability
+func (c *Credential) usableBy(request *Credential) bool {
+	if c.Password != "" {
+		return true
+	}
+
+	return c.Credential != "" && request.HasCapability(capabilityAuthType)
+}
+
+// sameKind reports whether both hold the same kind of secret, so an authtype
+// credential and a password for the same host are kept side by side
+func (c *Credential) sameKind(other *Credential) bool {
+	return (c.AuthType != "") == (other.AuthType != "")
+}
+
+// transformSecrets replaces every secret of c with the result of fn, which gets
+// the identity of c as additional data. It is used to encrypt, decrypt and rewrap.
+func transformSecrets(c *Credential, fn func(secret []byte, aad []byte) ([]byte, error)) error {
+	return transformSecretsWith(c, c.AdditionalData(), fn)
+}
+
+// decryptSecrets is transformSecrets for decrypting. Secrets sealed with the
+// identity in its URL form are decrypted with that identity.
+func decryptSecrets(c *Credential, decrypt func(ciphertext []byte, aad []byte) ([]byte, error)) error {
+	aad := c.AdditionalData()
+	err := transformSecretsWith(c, aad, decrypt)
+	if err == nil {
+		return nil
+	}
+
+	legacy, legacyErr := c.urlAdditionalData()
+	if legacyErr != nil || bytes.Equal(legacy, aad) {
+		return err
+	}
+
+	if transformSecretsWith(c, legacy, decrypt) != nil {
+		return err
+	}
+
+	return nil
+}
+
+// transformSecretsWith replaces every secret of c with the result of fn, c is
+// left as it is when fn fails for any of them
+func transformSecretsWith(c *Credential, aad []byte, fn func(secret []byte, aad []byte) ([]byte, error)) error {
+	secrets := c.secrets()
+	transformed := make([]string, len(secrets))
+
+	for idx, secret := range secrets {
+		value, err := fn([]byte(*secret), aad)
+		if err != nil {
+			return err
+		}
+
+		transformed[idx] = string(value)
+	}
+
+	for idx, secret := range secrets {
+		*secret = transformed[idx]
+	}
+
+	return nil
+}
+
+// usesMasterKey reports whether the stored secrets of c are encrypted with the
+// store master key rather than a passphrase of their own
+func usesMasterKey(c *Credential) (bool, error) {
+	secrets := c.secrets()
+	if len(secrets) == 0 {
+		return false, nil
+	}
+
+	return crypto.UsesMasterKey([]byte(*secrets[0]))
+}
@@ -1,34 +1,74 @@
 package main
 
-import "github.com/king-jam/git-credential-crypt-store/backend"
+import (
+	"github.com/king-jam/git-credential-crypt-store/backend"
+	"github.com/king-jam/git-credential-crypt-store/crypto"
+	"github.com/king-jam/git-credential-crypt-store/daemon"
+)
 
-func removeCredentials(db backend.CryptStoreInterface, credentials *Credential) error {
-	s, err := db.GetStorageContainer()
+// removeCredentials erases every stored credential matching the request. When
+// git sends the secret that failed, only entries holding that same secret are
+// erased, so a rejected token never takes a different, valid one with it.
+func removeCredentials(db backend.CryptStoreInterface, agent *daemon.Client, credentials *Credential) error {
+	// another git process may write in between, Update then looks again
+	keys := &masterKeySession{agent: agent}
+	return backend.Update(db, func(s *backend.StorageContainer) (bool, error) {
+		// iterate to find every matching credential
+		var match []int
+		for idx, e := range s.Entries {
+			c := credentialFromEntry(e)
+			if !CredentialsMatch(credentials, c) {
+				continue
+			}
+
+			same, err := secretMatches(agent, keys, s, c, credentials.authSecret())
+			if err != nil {
+				return false, err
+			}
+
+			if same {
+				match = append(match, idx)
+			}
+		}
+
+		if len(match) == 0 {
+			return false, nil
+		}
+
+		s.Entries = removeIndexes(s.Entries, match)
+		return true, nil
+	})
+}
+
+// secretMatches reports whether the stored c holds the plaintext secret, an
+// empty secret matches anything. The hash recorded on store is checked when
+// there is one, older entries have to be decrypted.
+func secretMatches(agent *daemon.Client, keys *masterKeySession, s *backend.StorageContainer, c *Credential, secret string) (bool, error) {
+	if secret == "" {
+		return true, nil
+	}
+
+	if c.secretHash != "" {
+		return crypto.VerifySecret([]byte(c.secretHash), []byte(secret))
+	}
+
+	usesMasterKey, err := usesMasterKey(c)
 	if err != nil {
-		return err
+		return false, err
 	}
-	// iterate to see if we already have these credentials stored
-	for idx, elem := range s.CredentialURLs {
-		c := new(Credential)
-		err := parseCredentialURL(elem, c)
+
+	if usesMasterKey {
+		mk, err := keys.unlock(s)
 		if err != nil {
-			return err
+			return false, err
 		}
 
-		if CredentialsMatch(credentials, c) {
-			// delete the current index
-			copy(s.CredentialURLs[idx:], s.CredentialURLs[idx+1:])
-			s.CredentialURLs[len(s.CredentialURLs)-1] = ""
-			s.CredentialURLs = s.CredentialURLs[:len(s.CredentialURLs)-1]
-			// persist the updated copy
-			err = db.PersistStorageContainer(s)
-			if err != nil {
-				return err
-			}
-
-			break
+		if err := decryptSecrets(c, mk.Decrypt); err != nil {
+			return false, err
 		}
+	} else if _, err := unlockCredential(agent, c); err != nil {
+		return false, err
 	}
 
-	return nil
+	return c.authSecret() == secret, nil
 }
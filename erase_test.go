@@ -0,0 +1,46 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/king-jam/git-credential-crypt-store/backend"
+)
+
+func TestEraseOnlyRemovesMatchingSecret(t *testing.T) {
+	prompter, restore := usePrompter(testPassphrase)
+	defer restore()
+	agent, cleanup := noAgent(t)
+	defer cleanup()
+
+	db := backend.NewMemoryStore()
+	mustStore(t, db, agent, testCredential("example.com", "alice", "rejected"))
+	mustStore(t, db, agent, testCredential("example.com", "bob", "valid"))
+	mustStore(t, db, agent, testCredential("example.com", "carol", "rejected"))
+	mustStore(t, db, agent, testCredential("example.org", "alice", "rejected"))
+
+	prompts := prompter.prompts
+	request := &Credential{Protocol: "https", Host: "example.com", Password: "rejected"}
+	if err := removeCredentials(db, agent, request); err != nil {
+		t.Fatal(err)
+	}
+	if prompter.prompts != prompts {
+		t.Fatal("erase prompted for the passphrase, the secret hashes should do")
+	}
+
+	var left []string
+	for _, c := range storedCredentials(t, db) {
+		left = append(left, c.Host+"/"+c.Username)
+	}
+	if len(left) != 2 || left[0] != "example.com/bob" || left[1] != "example.org/alice" {
+		t.Fatalf("erase left %v, want the valid secret and the other host", left)
+	}
+
+	// without a secret every matching credential goes
+	request = &Credential{Protocol: "https", Host: "example.com"}
+	if err := removeCredentials(db, agent, request); err != nil {
+		t.Fatal(err)
+	}
+	if left := storedCredentials(t, db); len(left) != 1 || left[0].Host != "example.org" {
+		t.Fatalf("erase without a secret left %d credentials, want the other host only", len(left))
+	}
+}
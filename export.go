@@ -0,0 +1,295 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/king-jam/git-credential-crypt-store/backend"
+	"github.com/king-jam/git-credential-crypt-store/crypto"
+	"github.com/king-jam/git-credential-crypt-store/daemon"
+	"github.com/king-jam/git-credential-crypt-store/dialogs"
+)
+
+const (
+	// exportFormat identifies an export bundle
+	exportFormat = "git-credential-crypt-store-export"
+	// exportVersion is the bundle version written by export, version 1 bundles
+	// hold the credentials in the URL form
+	exportVersion    = 2
+	exportVersionURL = 1
+	// exportDescription names the bundle passphrase in prompts
+	exportDescription = "the exported credentials"
+
+	conflictSkip      = "skip"
+	conflictOverwrite = "overwrite"
+	conflictKeepBoth  = "keep-both"
+)
+
+// exportBundle is a self-describing copy of the store. The ciphertexts are kept
+// as is, together with the wrapped master key they need. The MAC covers every
+// other field and is keyed from the master key.
+type exportBundle struct {
+	Format    string    `json:"format"`
+	Version   int       `json:"version"`
+	CreatedAt time.Time `json:"created_at"`
+	MasterKey string    `json:"master_key"`
+	// Credentials is kept raw so the MAC covers exactly what was written
+	Credentials json.RawMessage `json:"credentials"`
+	MAC         []byte          `json:"mac,omitempty"`
+}
+
+// payload returns the bytes covered by the MAC
+func (b *exportBundle) payload() ([]byte, error) {
+	unsigned := *b
+	unsigned.MAC = nil
+
+	return json.Marshal(&unsigned)
+}
+
+// entries decodes the credentials of the bundle in any version we wrote
+func (b *exportBundle) entries() ([]backend.Entry, error) {
+	var entries []backend.Entry
+	if b.Version != exportVersionURL {
+		err := json.Unmarshal(b.Credentials, &entries)
+		return entries, err
+	}
+
+	var urls []string
+	if err := json.Unmarshal(b.Credentials, &urls); err != nil {
+		return nil, err
+	}
+
+	for _, rawurl := range urls {
+		e, err := backend.EntryFromURL(rawurl)
+		if err != nil {
+			return nil, err
+		}
+
+		entries = append(entries, e)
+	}
+
+	return entries, nil
+}
+
+func exportCredentials(db backend.CryptStoreInterface, agent *daemon.Client, out io.Writer, args []string) error {
+	flags := flag.NewFlagSet("export", flag.ContinueOnError)
+	filter := addFilterFlags(flags)
+
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	s, err := db.GetStorageContainer()
+	if err != nil {
+		return err
+	}
+
+	if s.MasterKey == "" {
+		return fmt.Errorf("the store has no master key yet, run passwd first")
+	}
+	// the MAC needs the master key, which also proves the passphrase is known
+	mk, err := unlockMasterKey(agent, s)
+	if err != nil {
+		return err
+	}
+
+	entries := make([]backend.Entry, 0, len(s.Entries))
+	for _, e := range s.Entries {
+		if filter.matches(credentialFromEntry(e)) {
+			entries = append(entries, e)
+		}
+	}
+
+	credentials, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+
+	bundle := &exportBundle{
+		Format:      exportFormat,
+		Version:     exportVersion,
+		CreatedAt:   time.Now().UTC(),
+		MasterKey:   s.MasterKey,
+		Credentials: credentials,
+	}
+
+	payload, err := bundle.payload()
+	if err != nil {
+		return err
+	}
+
+	bundle.MAC = mk.Sum(payload)
+
+	data, err := json.MarshalIndent(bundle, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if flags.NArg() > 0 && flags.Arg(0) != "-" {
+		return ioutil.WriteFile(flags.Arg(0), append(data, '\n'), 0600)
+	}
+
+	_, err = fmt.Fprintln(out, string(data))
+	return err
+}
+
+func importCredentials(db backend.CryptStoreInterface, agent *daemon.Client, in io.Reader, out io.Writer, args []string) error {
+	flags := flag.NewFlagSet("import", flag.ContinueOnError)
+	conflict := flags.String("conflict", conflictSkip, "What to do with credentials that are already stored: skip, overwrite or keep-both.")
+
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	switch *conflict {
+	case conflictSkip, conflictOverwrite, conflictKeepBoth:
+	default:
+		return fmt.Errorf("unknown conflict policy %q", *conflict)
+	}
+
+	if flags.NArg() > 0 && flags.Arg(0) != "-" {
+		f, err := os.Open(flags.Arg(0))
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		in = f
+	}
+
+	bundle := new(exportBundle)
+	if err := json.NewDecoder(in).Decode(bundle); err != nil {
+		return err
+	}
+
+	if bundle.Format != exportFormat {
+		return fmt.Errorf("not an export bundle")
+	}
+
+	if bundle.Version != exportVersion && bundle.Version != exportVersionURL {
+		return fmt.Errorf("unsupported export bundle version %d", bundle.Version)
+	}
+
+	passphrase, err := dialogs.PasswordBox(exportDescription)
+	if err != nil {
+		return err
+	}
+
+	bundleMK, err := crypto.UnwrapMasterKey([]byte(bundle.MasterKey), passphrase)
+	if err != nil {
+		return err
+	}
+
+	payload, err := bundle.payload()
+	if err != nil {
+		return err
+	}
+
+	if !bundleMK.Verify(payload, bundle.MAC) {
+		return fmt.Errorf("export bundle failed its integrity check")
+	}
+
+	entries, err := bundle.entries()
+	if err != nil {
+		return err
+	}
+
+	// another git process may write in between, Update then imports into what
+	// it wrote
+	keys := &masterKeySession{agent: agent}
+	var imported, skipped int
+	err = backend.Update(db, func(s *backend.StorageContainer) (bool, error) {
+		imported, skipped = 0, 0
+		// an empty store simply takes over the master key of the bundle
+		mk := bundleMK
+		adopted := s.MasterKey == ""
+		if adopted {
+			s.MasterKey = bundle.MasterKey
+		} else {
+			unlocked, err := keys.unlock(s)
+			if err != nil {
+				return false, err
+			}
+
+			mk = unlocked
+		}
+
+		for _, e := range entries {
+			c := credentialFromEntry(e)
+			usesMasterKey, err := usesMasterKey(c)
+			if err != nil {
+				return false, err
+			}
+			// only the data key moves to our master key, the ciphertext stays as is
+			if usesMasterKey && !mk.Equal(bundleMK) {
+				err := transformSecrets(c, func(ciphertext []byte, _ []byte) ([]byte, error) {
+					return crypto.RewrapDataKey(ciphertext, bundleMK, mk)
+				})
+				if err != nil {
+					return false, err
+				}
+
+				e = storedEntry(c)
+			}
+
+			match := matchingIndexes(s, c)
+
+			switch {
+			case len(match) == 0 || *conflict == conflictKeepBoth:
+				s.Entries = append(s.Entries, e)
+			case *conflict == conflictOverwrite:
+				// the imported credential takes the place of the stored one
+				e.ID = s.Entries[match[0]].ID
+				s.Entries[match[0]] = e
+				s.Entries = removeIndexes(s.Entries, match[1:])
+			default:
+				skipped++
+				continue
+			}
+
+			imported++
+		}
+		// a single AtomicPut, so either the whole bundle is imported or nothing is
+		return adopted || imported > 0, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(out, "imported %d credentials, skipped %d\n", imported, skipped)
+	return err
+}
+
+// matchingIndexes returns the index of every stored credential matching c
+func matchingIndexes(s *backend.StorageContainer, c *Credential) []int {
+	var match []int
+
+	for idx, e := range s.Entries {
+		if CredentialsMatch(c, credentialFromEntry(e)) {
+			match = append(match, idx)
+		}
+	}
+
+	return match
+}
+
+// removeIndexes returns entries without the ones at the provided ascending indexes
+func removeIndexes(entries []backend.Entry, indexes []int) []backend.Entry {
+	kept := entries[:0]
+
+	for idx, elem := range entries {
+		if len(indexes) > 0 && indexes[0] == idx {
+			indexes = indexes[1:]
+			continue
+		}
+
+		kept = append(kept, elem)
+	}
+
+	return kept
+}
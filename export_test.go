@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/king-jam/git-credential-crypt-store/backend"
+)
+
+func TestImportRejectsTamperedBundle(t *testing.T) {
+	_, restore := usePrompter(testPassphrase)
+	defer restore()
+	agent, cleanup := noAgent(t)
+	defer cleanup()
+
+	db := backend.NewMemoryStore()
+	mustStore(t, db, agent, testCredential("example.com", "alice", "secret"))
+
+	var out bytes.Buffer
+	if err := exportCredentials(db, agent, &out, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	bundle := new(exportBundle)
+	if err := json.Unmarshal(out.Bytes(), bundle); err != nil {
+		t.Fatal(err)
+	}
+
+	// point the credential at another host, the ciphertext is left alone
+	var entries []map[string]interface{}
+	if err := json.Unmarshal(bundle.Credentials, &entries); err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		e["host"] = "attacker.example"
+	}
+	tampered, err := json.Marshal(entries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bundle.Credentials = tampered
+
+	data, err := json.Marshal(bundle)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	target := backend.NewMemoryStore()
+	err = importCredentials(target, agent, bytes.NewReader(data), ioutil.Discard, nil)
+	if err == nil || !strings.Contains(err.Error(), "integrity check") {
+		t.Fatalf("imported a tampered bundle: %v", err)
+	}
+	if left := storedCredentials(t, target); len(left) != 0 {
+		t.Fatalf("a rejected bundle stored %d credentials", len(left))
+	}
+
+	// the bundle as it was exported is fine
+	if err := importCredentials(target, agent, &out, ioutil.Discard, nil); err != nil {
+		t.Fatal(err)
+	}
+	if left := storedCredentials(t, target); len(left) != 1 || left[0].Host != "example.com" {
+		t.Fatal("the untouched bundle wasn't imported")
+	}
+}
@@ -1,42 +1,193 @@
 package main
 
 import (
+	"fmt"
+	"os"
+	"time"
+
 	"github.com/king-jam/git-credential-crypt-store/backend"
 	"github.com/king-jam/git-credential-crypt-store/crypto"
+	"github.com/king-jam/git-credential-crypt-store/daemon"
 	"github.com/king-jam/git-credential-crypt-store/dialogs"
 )
 
-func lookupCredentials(db backend.CryptStoreInterface, credentials *Credential) error {
+func lookupCredentials(db backend.CryptStoreInterface, agent *daemon.Client, credentials *Credential) error {
 	var s *backend.StorageContainer
 	s, err := db.GetStorageContainer()
 	if err != nil {
 		return err
 	}
 	// iterate to see if we already have these credentials stored
-	for _, elem := range s.CredentialURLs {
-		c := new(Credential)
-		err := parseCredentialURL(elem, c)
-		if err != nil {
-			return err
-		}
-
-		if CredentialsMatch(credentials, c) {
-			password, err := dialogs.PasswordBox(c.Username)
-			if err != nil {
-				return err
+	for _, e := range s.Entries {
+		c := credentialFromEntry(e)
+		if CredentialsMatch(credentials, c) && c.usableBy(credentials) {
+			// an expired token only earns a 401, let git ask for a new one instead
+			if c.Expired(time.Now()) {
+				fmt.Fprintf(os.Stderr, "warning: skipping the credential for %s, it expired, run prune to remove it\n", c.Host)
+				continue
 			}
-			cipher, err := crypto.NewCipher(password)
+			// an entry on its own passphrase is moved under the master key
+			var upgraded *Credential
+			usesMasterKey, err := usesMasterKey(c)
 			if err != nil {
 				return err
 			}
-			decryptedPassword, err := cipher.Decrypt([]byte(c.Password))
-			if err != nil {
-				return err
+			if usesMasterKey {
+				mk, err := unlockMasterKey(agent, s)
+				if err != nil {
+					return err
+				}
+				if err := decryptSecrets(c, mk.Decrypt); err != nil {
+					return err
+				}
+				c.PrintToStdOut(credentials.Capability)
+			} else {
+				// entries from before the master key have their own passphrase
+				password, err := unlockCredential(agent, c)
+				if err != nil {
+					return err
+				}
+				c.PrintToStdOut(credentials.Capability)
+				upgraded, err = upgradeCredential(agent, s, c, password)
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "warning: unable to upgrade stored credential: %s\n", err)
+				}
+			}
+			// the credential was handed out already, so failing to save is only a warning
+			if err := recordUse(db, e, s.MasterKey, upgraded); err != nil {
+				fmt.Fprintf(os.Stderr, "warning: unable to record the use of the stored credential: %s\n", err)
 			}
-			c.Password = string(decryptedPassword)
-			c.PrintToStdOut()
 			return nil
 		}
 	}
 	return nil
 }
+
+// recordUse updates the usage metadata of the entry that was read as e. An
+// upgraded credential, encrypted under the master key wrapped as masterKey,
+// takes its place as long as neither changed since. Another process may write
+// in between, so the entry is looked up again on every attempt.
+func recordUse(db backend.CryptStoreInterface, e backend.Entry, masterKey string, upgraded *Credential) error {
+	now := time.Now()
+
+	return backend.Update(db, func(s *backend.StorageContainer) (bool, error) {
+		idx := indexOfEntry(s, e)
+		if idx == -1 {
+			// erased in the meantime, there is nothing left to record
+			return false, nil
+		}
+
+		current := s.Entries[idx]
+		c := credentialFromEntry(current)
+		sameSecret := current.Password == e.Password && current.Credential == e.Credential
+		if upgraded != nil && sameSecret && (s.MasterKey == masterKey || s.MasterKey == "") {
+			s.MasterKey = masterKey
+			// keep the uses recorded by others in the meantime
+			replacement := *upgraded
+			replacement.metadata = c.metadata
+			c = &replacement
+		}
+
+		c.metadata.recordUse(now)
+		s.Entries[idx] = storedEntry(c)
+		return true, nil
+	})
+}
+
+// indexOfEntry finds the entry read as e in s. Backends that store entries one
+// by one identify them, otherwise the same identity and ciphertext is looked
+// for, ciphertexts never repeat.
+func indexOfEntry(s *backend.StorageContainer, e backend.Entry) int {
+	for idx, current := range s.Entries {
+		if e.ID != 0 {
+			if current.ID == e.ID {
+				return idx
+			}
+			continue
+		}
+
+		if current.Protocol == e.Protocol && current.Host == e.Host && current.Path == e.Path &&
+			current.Username == e.Username && current.Password == e.Password && current.Credential == e.Credential {
+			return idx
+		}
+	}
+
+	return -1
+}
+
+// unlockCredential decrypts the stored secrets of c that are keyed by its own
+// passphrase and returns that passphrase. A passphrase cached by the daemon is
+// tried first, we only prompt when there is none or it no longer works.
+func unlockCredential(agent *daemon.Client, c *Credential) (string, error) {
+	identity, err := c.Identity()
+	if err != nil {
+		return "", err
+	}
+	// a daemon that isn't running is the same as an empty cache
+	if password, err := agent.Get(identity); err == nil && password != "" {
+		unlocked := *c
+		if err := decryptSecrets(&unlocked, decryptWithPassphrase(password)); err == nil {
+			*c = unlocked
+			return password, nil
+		}
+	}
+
+	password, err := dialogs.PasswordBox(c.Username)
+	if err != nil {
+		return "", err
+	}
+
+	if err := decryptSecrets(c, decryptWithPassphrase(password)); err != nil {
+		return "", err
+	}
+	// caching is best effort, we already have what we came for
+	_ = agent.Store(identity, password)
+
+	return password, nil
+}
+
+// decryptWithPassphrase returns a transform for decryptSecrets that decrypts
+// values keyed by the provided passphrase
+func decryptWithPassphrase(password string) func(ciphertext []byte, aad []byte) ([]byte, error) {
+	return func(ciphertext []byte, aad []byte) ([]byte, error) {
+		cipher, err := crypto.NewCipher(password)
+		if err != nil {
+			return nil, err
+		}
+
+		return cipher.Decrypt(ciphertext, aad)
+	}
+}
+
+// upgradeCredential re-encrypts an entry keyed by its own passphrase under the
+// store master key, c holds the plaintext. A store without a master key adopts
+// the passphrase of the entry. Otherwise the master key must be cached or share
+// that passphrase, as we won't prompt a second time during a get. It returns
+// nil when the entry has to stay on its own passphrase.
+func upgradeCredential(agent *daemon.Client, s *backend.StorageContainer, c *Credential, password string) (*Credential, error) {
+	var mk *crypto.MasterKey
+	var err error
+
+	if s.MasterKey == "" {
+		mk, err = newMasterKey(agent, s, password)
+		if err != nil {
+			return nil, err
+		}
+	} else if mk = cachedMasterKey(agent, s); mk == nil {
+		mk, err = crypto.UnwrapMasterKey([]byte(s.MasterKey), password)
+		if err != nil {
+			// the entry stays on its own passphrase until the next passwd
+			return nil, nil
+		}
+	}
+
+	upgraded := *c
+	if err := hashSecret(&upgraded); err != nil {
+		return nil, err
+	}
+	if err := transformSecrets(&upgraded, mk.Encrypt); err != nil {
+		return nil, err
+	}
+
+	return &upgraded, nil
+}
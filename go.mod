@@ -1,11 +1,18 @@
 module github.com/king-jam/git-credential-crypt-store
 
 require (
+	github.com/BurntSushi/toml v1.2.1
 	github.com/boltdb/bolt v1.3.1 // indirect
+	github.com/coreos/etcd v3.3.10+incompatible
+	github.com/coreos/go-semver v0.2.0 // indirect
 	github.com/docker/libkv v0.2.1
+	github.com/hashicorp/consul/api v1.4.0
 	github.com/mitchellh/go-homedir v1.1.0
-	github.com/stretchr/testify v1.3.0 // indirect
-	golang.org/x/sys v0.0.0-20180501092740-78d5f264b493 // indirect
+	github.com/samuel/go-zookeeper v0.0.0-20180130194729-c4fab1ac1bec
+	github.com/ugorji/go v1.1.1 // indirect
+	go.etcd.io/bbolt v1.3.6
+	golang.org/x/crypto v0.0.0-20211117183948-ae814b36b871
+	golang.org/x/term v0.0.0-20210503060354-a79de5458b56
 )
 
 go 1.13
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/king-jam/git-credential-crypt-store/backend"
+)
+
+const (
+	listFormatTable = "table"
+	listFormatJSON  = "json"
+)
+
+// credentialFilter narrows a command down to the credentials it should touch
+type credentialFilter struct {
+	host     string
+	protocol string
+}
+
+// addFilterFlags registers the filter options on a command
+func addFilterFlags(flags *flag.FlagSet) *credentialFilter {
+	f := new(credentialFilter)
+	flags.StringVar(&f.host, "host", "", "Only use credentials for this host.")
+	flags.StringVar(&f.protocol, "protocol", "", "Only use credentials for this protocol.")
+
+	return f
+}
+
+// matches reports whether the credential passes the filter
+func (f *credentialFilter) matches(c *Credential) bool {
+	if f.host != "" && c.Host != f.host {
+		return false
+	}
+
+	if f.protocol != "" && c.Protocol != f.protocol {
+		return false
+	}
+
+	return true
+}
+
+// listEntry is what we show for a stored credential, it never holds the secret
+type listEntry struct {
+	Protocol string `json:"protocol"`
+	Host     string `json:"host"`
+	Path     string `json:"path"`
+	Username string `json:"username"`
+	// ExpiresAt is the password expiry git provided, if any
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	// the usage metadata is missing for credentials stored by older versions
+	CreatedAt  *time.Time `json:"created_at,omitempty"`
+	UpdatedAt  *time.Time `json:"updated_at,omitempty"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+	UseCount   uint64     `json:"use_count"`
+}
+
+func listCredentials(db backend.CryptStoreInterface, out io.Writer, args []string) error {
+	flags := flag.NewFlagSet("list", flag.ContinueOnError)
+	filter := addFilterFlags(flags)
+	format := flags.String("format", listFormatTable, "Output format, table or json.")
+	unusedFor := flags.String("unused-for", "", "Only list credentials not used for this long, e.g. 90d or 12h.")
+
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if *format != listFormatTable && *format != listFormatJSON {
+		return fmt.Errorf("unknown list format %q", *format)
+	}
+
+	var unusedSince time.Time
+	if *unusedFor != "" {
+		age, err := parseAge(*unusedFor)
+		if err != nil {
+			return err
+		}
+
+		unusedSince = time.Now().Add(-age)
+	}
+
+	s, err := db.GetStorageContainer()
+	if err != nil {
+		return err
+	}
+
+	entries := make([]listEntry, 0, len(s.Entries))
+	for _, stored := range s.Entries {
+		c := credentialFromEntry(stored)
+		if !filter.matches(c) {
+			continue
+		}
+		// never used counts as unused since it was stored
+		if !unusedSince.IsZero() && lastActivity(c).After(unusedSince) {
+			continue
+		}
+
+		e := listEntry{
+			Protocol:   c.Protocol,
+			Host:       c.Host,
+			Path:       c.Path,
+			Username:   c.Username,
+			CreatedAt:  optionalTime(c.metadata.CreatedAt),
+			UpdatedAt:  optionalTime(c.metadata.UpdatedAt),
+			LastUsedAt: optionalTime(c.metadata.LastUsedAt),
+			UseCount:   c.metadata.UseCount,
+		}
+		if expiry, ok := c.PasswordExpiry(); ok {
+			e.ExpiresAt = &expiry
+		}
+
+		entries = append(entries, e)
+	}
+
+	if *format == listFormatJSON {
+		encoder := json.NewEncoder(out)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(entries)
+	}
+
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "PROTOCOL\tHOST\tPATH\tUSERNAME\tEXPIRES\tLAST USED\tUSES")
+	now := time.Now()
+	for _, e := range entries {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%d\n", e.Protocol, e.Host, e.Path, e.Username,
+			formatExpiry(e.ExpiresAt, now), formatLastUsed(e.LastUsedAt, now), e.UseCount)
+	}
+
+	return w.Flush()
+}
+
+// formatExpiry shows the time left until expiry, or how long ago it expired
+func formatExpiry(expiry *time.Time, now time.Time) string {
+	if expiry == nil {
+		return "never"
+	}
+
+	left := expiry.Sub(now).Truncate(time.Minute)
+	if left <= 0 {
+		return fmt.Sprintf("expired %s ago", formatDuration(-left))
+	}
+
+	return fmt.Sprintf("in %s", formatDuration(left))
+}
+
+// formatLastUsed shows how long ago the credential was handed out
+func formatLastUsed(lastUsed *time.Time, now time.Time) string {
+	if lastUsed == nil {
+		return "never"
+	}
+
+	return fmt.Sprintf("%s ago", formatDuration(now.Sub(*lastUsed).Truncate(time.Minute)))
+}
+
+// lastActivity is when the credential was last used, or stored if it never was
+func lastActivity(c *Credential) time.Time {
+	for _, t := range []time.Time{c.metadata.LastUsedAt, c.metadata.UpdatedAt, c.metadata.CreatedAt} {
+		if !t.IsZero() {
+			return t
+		}
+	}
+
+	return time.Time{}
+}
+
+// parseAge parses a duration that may also be given in days, e.g. 90d
+func parseAge(s string) (time.Duration, error) {
+	if strings.HasSuffix(s, "d") {
+		days, err := strconv.Atoi(strings.TrimSuffix(s, "d"))
+		if err != nil {
+			return 0, fmt.Errorf("invalid age %q", s)
+		}
+
+		return time.Duration(days) * 24 * time.Hour, nil
+	}
+
+	return time.ParseDuration(s)
+}
+
+// formatDuration rounds d to the two largest units that are of any interest
+func formatDuration(d time.Duration) string {
+	day := 24 * time.Hour
+
+	switch {
+	case d >= day:
+		return fmt.Sprintf("%dd%dh", d/day, (d%day)/time.Hour)
+	case d >= time.Hour:
+		return fmt.Sprintf("%dh%dm", d/time.Hour, (d%time.Hour)/time.Minute)
+	default:
+		return fmt.Sprintf("%dm", d/time.Minute)
+	}
+}
@@ -4,23 +4,67 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"path/filepath"
+	"time"
 
 	"github.com/king-jam/git-credential-crypt-store/backend"
+	"github.com/king-jam/git-credential-crypt-store/daemon"
+	"github.com/king-jam/git-credential-crypt-store/dialogs"
 	homedir "github.com/mitchellh/go-homedir"
 )
 
-const storeFileName = ".git-credential-crypt-store"
+// storeDirName is the directory of the store below the configuration directory,
+// it is accessible by us only
+const storeDirName = "git-credential-crypt-store"
 
-const storeLocationDefault = "~/" + storeFileName
+const storeFileName = "store.db"
+
+const storeLocationDefault = "~/.config/" + storeDirName + "/" + storeFileName
+
+// legacyStoreFileName is where earlier versions kept the store, directly in the
+// home directory
+const legacyStoreFileName = ".git-credential-crypt-store"
+
+const socketLocationDefault = "~/.git-credential-crypt-store-daemon/socket"
+
+// prompterEnv selects the password prompt when -prompter isn't given
+const prompterEnv = "GIT_CREDENTIAL_CRYPT_STORE_PROMPTER"
+
+// pinentryEnv selects the pinentry program when -pinentry isn't given
+const pinentryEnv = "GIT_CREDENTIAL_CRYPT_STORE_PINENTRY"
 
 func main() {
 	var storeLocation string
+	var storeURI string
+	var socketLocation string
+	var timeout time.Duration
+	var prompter string
+	var pinentry string
+	var warnInsecure bool
 
-	flag.StringVar(&storeLocation, "file", storeLocationDefault, "Location to store the credentials.")
+	flag.StringVar(&storeLocation, "file", storeLocationDefault, "Location to store the credentials. The default is below $XDG_CONFIG_HOME when it is set.")
+	flag.StringVar(&storeURI, "store", "", "Store location as a URI, e.g. bolt:///path, file:///path.json, memory://, consul://host:port/prefix, etcd://host:port/prefix or zk://host:port/prefix. Overrides -file.")
+	flag.StringVar(&socketLocation, "socket", socketLocationDefault, "Location of the daemon socket.")
+	flag.DurationVar(&timeout, "timeout", daemon.DefaultTimeout, "How long the daemon caches unlocked keys.")
+	flag.StringVar(&prompter, "prompter", "", "Password prompt to use: auto, zenity, kdialog, pinentry, askpass or tty. Defaults to $"+prompterEnv+" or auto.")
+	flag.BoolVar(&warnInsecure, "warn-insecure-permissions", false, "Only warn when the store file is accessible by others or owned by another user, instead of refusing to open it.")
+	flag.StringVar(&pinentry, "pinentry", "", "Pinentry program to use, implies -prompter pinentry. Defaults to $"+pinentryEnv+" or pinentry.")
 	// define a quick helper function for usage so we can let people know
 	flag.Usage = func() {
 		fmt.Fprint(os.Stderr, "Usage:\n")
 		fmt.Fprint(os.Stderr, "  git-credential-crypt-store [OPTIONS] [CMD]\n\n")
+		fmt.Fprint(os.Stderr, "Commands:\n")
+		fmt.Fprint(os.Stderr, "  get, store, erase  git credential helper operations\n")
+		fmt.Fprint(os.Stderr, "  list               show stored credentials without decrypting them\n")
+		fmt.Fprint(os.Stderr, "  prune              erase credentials whose password expired\n")
+		fmt.Fprint(os.Stderr, "  passwd             change the store passphrase\n")
+		fmt.Fprint(os.Stderr, "  rekey              change the store passphrase and rotate the master key\n")
+		fmt.Fprint(os.Stderr, "  export [FILE]      write an integrity protected copy of the store\n")
+		fmt.Fprint(os.Stderr, "  import [FILE]      merge an exported copy into the store\n")
+		fmt.Fprint(os.Stderr, "  migrate            bring the store up to the current schema, see -dry-run\n")
+		fmt.Fprint(os.Stderr, "  daemon             cache unlocked keys in memory until the timeout\n")
+		fmt.Fprint(os.Stderr, "  forget             drop every key cached by the daemon\n")
+		fmt.Fprint(os.Stderr, "  exit               stop the daemon\n\n")
 
 		title := "git credential helper to store passwords encrypted to enable usage of access tokens with 2FA."
 		fmt.Fprint(os.Stderr, title+"\n\n")
@@ -31,41 +75,138 @@ func main() {
 	flag.Parse()
 
 	if storeLocation == storeLocationDefault {
-		home, err := homedir.Dir()
+		location, err := defaultStoreLocation()
 		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		storeLocation = location
+	}
+	if storeURI != "" {
+		storeLocation = storeURI
+	}
+	if warnInsecure {
+		backend.WarnOnInsecurePermissions(func(err error) {
+			fmt.Fprintf(os.Stderr, "warning: %s\n", err)
+		})
+	}
+	socketLocation, err := homedir.Expand(socketLocation)
+	if err != nil {
+		os.Exit(1)
+	}
+	// an explicit prompter must work, auto detection happens on the first prompt
+	if prompter == "" {
+		prompter = os.Getenv(prompterEnv)
+	}
+	if pinentry == "" {
+		pinentry = os.Getenv(pinentryEnv)
+	}
+	if pinentry != "" && (prompter == "" || prompter == dialogs.PrompterPinentry) {
+		dialogs.Use(dialogs.NewPinentry(pinentry))
+	} else if prompter != "" && prompter != dialogs.PrompterAuto {
+		if err := dialogs.Select(prompter); err != nil {
+			fmt.Fprintln(os.Stderr, err)
 			os.Exit(1)
 		}
-		storeLocation = home + "/.git-credential-crypt-store"
 	}
 	// if we don't get anything after the program, just give an error back
 	if len(os.Args[1:]) == 0 {
 		flag.Usage()
 	}
+	// the command is the first argument after the options, anything after it
+	// belongs to the command
+	op := flag.Arg(0)
+	args := flag.Args()[1:]
+	// the daemon commands don't touch the store or read any input, migrate
+	// opens the store on its own
+	agent := daemon.NewClient(socketLocation)
+	switch op {
+	case "daemon":
+		if err := daemon.NewServer(socketLocation, timeout).Serve(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	case "forget":
+		if err := agent.Forget(); err != nil && err != daemon.ErrNotRunning {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	case "exit":
+		if err := agent.Exit(); err != nil && err != daemon.ErrNotRunning {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	case "migrate":
+		if err := migrateStore(storeLocation, os.Stdout, args); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
 	// open up the credential storage
-	cs, err := backend.OpenCryptStore(storeLocation)
+	cs, err := backend.Open(storeLocation)
 	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
 		os.Exit(1)
 	}
+	// the store commands don't read any input either
+	switch op {
+	case "list":
+		if err := listCredentials(cs, os.Stdout, args); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	case "prune":
+		if err := pruneCredentials(cs, os.Stdout, args); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	case "passwd", "rekey":
+		if err := changePassphrase(cs, agent, args, op == "rekey"); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	case "export":
+		if err := exportCredentials(cs, agent, os.Stdout, args); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	case "import":
+		if err := importCredentials(cs, agent, os.Stdin, os.Stdout, args); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
 	// if we got here then the input arguments are at least correct
 	// parse in the credentials
 	creds, err := ParseCredentialStdin()
 	if err != nil {
 		os.Exit(1)
 	}
-	// just grab the last argument at this point, if it isn't a command, just ignore it
-	switch op := os.Args[len(os.Args)-1]; op {
+	// git asks about a single host, backends keeping hosts apart only touch that one
+	db := backend.ForHost(cs, creds.Host)
+	// if it isn't a command, just ignore it
+	switch op {
 	case "get":
-		if err := lookupCredentials(cs, creds); err != nil {
+		if err := lookupCredentials(db, agent, creds); err != nil {
 			fmt.Fprintln(os.Stderr, err)
 			os.Exit(1)
 		}
 	case "store":
-		if err := storeCredentials(cs, creds); err != nil {
+		if err := storeCredentials(db, agent, creds); err != nil {
 			fmt.Fprintln(os.Stderr, err)
 			os.Exit(1)
 		}
 	case "erase":
-		if err := removeCredentials(cs, creds); err != nil {
+		if err := removeCredentials(db, agent, creds); err != nil {
 			fmt.Fprintln(os.Stderr, err)
 			os.Exit(1)
 		}
@@ -75,3 +216,44 @@ func main() {
 
 	os.Exit(0)
 }
+
+// defaultStoreLocation returns the store in a directory of its own below
+// $XDG_CONFIG_HOME or ~/.config, which only we can access. A store left in the
+// home directory by an earlier version is moved there.
+func defaultStoreLocation() (string, error) {
+	home, err := homedir.Dir()
+	if err != nil {
+		return "", err
+	}
+
+	config := os.Getenv("XDG_CONFIG_HOME")
+	if config == "" {
+		config = filepath.Join(home, ".config")
+	}
+
+	dir := filepath.Join(config, storeDirName)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+	// the directory is ours alone, whatever it was created with
+	if err := os.Chmod(dir, 0700); err != nil {
+		return "", err
+	}
+
+	location := filepath.Join(dir, storeFileName)
+	if _, err := os.Lstat(location); !os.IsNotExist(err) {
+		return location, nil
+	}
+
+	legacy := filepath.Join(home, legacyStoreFileName)
+	info, err := os.Lstat(legacy)
+	if err != nil || !info.Mode().IsRegular() {
+		return location, nil
+	}
+	// another git process may have moved it first
+	if err := os.Rename(legacy, location); err != nil && !os.IsNotExist(err) {
+		return "", fmt.Errorf("moving the store from %s to %s failed: %s", legacy, location, err)
+	}
+
+	return location, nil
+}
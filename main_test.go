@@ -0,0 +1,99 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/king-jam/git-credential-crypt-store/backend"
+	"github.com/king-jam/git-credential-crypt-store/daemon"
+	"github.com/king-jam/git-credential-crypt-store/dialogs"
+)
+
+const testPassphrase = "correct horse battery staple"
+
+// fakePrompter answers every prompt with passphrase and counts the prompts
+type fakePrompter struct {
+	passphrase string
+	prompts    int
+}
+
+func (p *fakePrompter) PasswordBox(user string) (string, error) {
+	p.prompts++
+	return p.passphrase, nil
+}
+
+func (p *fakePrompter) PasswordCreationBox(user string) (string, error) {
+	p.prompts++
+	return p.passphrase, nil
+}
+
+// usePrompter makes a fakePrompter answer the prompts until the returned
+// function is called
+func usePrompter(passphrase string) (*fakePrompter, func()) {
+	p := &fakePrompter{passphrase: passphrase}
+	dialogs.Use(p)
+
+	return p, func() { dialogs.Use(nil) }
+}
+
+// noAgent returns a client of a daemon that isn't running, so nothing is cached
+func noAgent(t *testing.T) (*daemon.Client, func()) {
+	dir, err := ioutil.TempDir("", "agent")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return daemon.NewClient(filepath.Join(dir, "socket")), func() { os.RemoveAll(dir) }
+}
+
+func testCredential(host, username, password string) *Credential {
+	return &Credential{
+		Protocol: "https",
+		Host:     host,
+		Username: username,
+		Password: password,
+	}
+}
+
+func mustStore(t *testing.T, db backend.CryptStoreInterface, agent *daemon.Client, c *Credential) {
+	t.Helper()
+
+	if err := storeCredentials(db, agent, c); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// storedCredentials returns the credentials of db, their secrets are encrypted
+func storedCredentials(t *testing.T, db backend.CryptStoreInterface) []*Credential {
+	t.Helper()
+
+	s, err := db.GetStorageContainer()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var ret []*Credential
+	for _, e := range s.Entries {
+		ret = append(ret, credentialFromEntry(e))
+	}
+
+	return ret
+}
+
+// racingStore lets another writer in right before the first write, the way a
+// parallel git process would
+type racingStore struct {
+	backend.CryptStoreInterface
+	race func()
+}
+
+func (r *racingStore) PersistStorageContainer(s *backend.StorageContainer) error {
+	if race := r.race; race != nil {
+		r.race = nil
+		race()
+	}
+
+	return r.CryptStoreInterface.PersistStorageContainer(s)
+}
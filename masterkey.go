@@ -0,0 +1,131 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+
+	"github.com/king-jam/git-credential-crypt-store/backend"
+	"github.com/king-jam/git-credential-crypt-store/crypto"
+	"github.com/king-jam/git-credential-crypt-store/daemon"
+	"github.com/king-jam/git-credential-crypt-store/dialogs"
+)
+
+// storeDescription names the store passphrase in prompts
+const storeDescription = "the credential store"
+
+// masterKeyCacheName names the master key of this store when talking to the daemon.
+// It changes whenever the master key is rewrapped, so a stale cache is never used.
+func masterKeyCacheName(s *backend.StorageContainer) string {
+	sum := sha256.Sum256([]byte(s.MasterKey))
+	return "master-key:" + hex.EncodeToString(sum[:])
+}
+
+// openMasterKey unlocks the store master key, creating it on first use
+func openMasterKey(agent *daemon.Client, s *backend.StorageContainer) (*crypto.MasterKey, error) {
+	if s.MasterKey == "" {
+		return createMasterKey(agent, s)
+	}
+
+	return unlockMasterKey(agent, s)
+}
+
+// masterKeySession keeps the master key over the attempts of a backend.Update, so
+// a retry only prompts again when another process changed the key in between
+type masterKeySession struct {
+	agent   *daemon.Client
+	wrapped string
+	mk      *crypto.MasterKey
+}
+
+// open returns the master key of s like openMasterKey does. A master key we
+// created on an earlier attempt is used again when s still has none.
+func (m *masterKeySession) open(s *backend.StorageContainer) (*crypto.MasterKey, error) {
+	return m.get(s, openMasterKey)
+}
+
+// unlock returns the master key of s like unlockMasterKey does
+func (m *masterKeySession) unlock(s *backend.StorageContainer) (*crypto.MasterKey, error) {
+	return m.get(s, unlockMasterKey)
+}
+
+func (m *masterKeySession) get(s *backend.StorageContainer, fn func(*daemon.Client, *backend.StorageContainer) (*crypto.MasterKey, error)) (*crypto.MasterKey, error) {
+	if m.mk != nil && (s.MasterKey == m.wrapped || s.MasterKey == "") {
+		s.MasterKey = m.wrapped
+		return m.mk, nil
+	}
+
+	mk, err := fn(m.agent, s)
+	if err != nil {
+		return nil, err
+	}
+
+	m.wrapped, m.mk = s.MasterKey, mk
+	return mk, nil
+}
+
+// createMasterKey generates the store master key and wraps it with a new passphrase
+func createMasterKey(agent *daemon.Client, s *backend.StorageContainer) (*crypto.MasterKey, error) {
+	passphrase, err := dialogs.PasswordCreationBox(storeDescription)
+	if err != nil {
+		return nil, err
+	}
+
+	return newMasterKey(agent, s, passphrase)
+}
+
+// newMasterKey generates the store master key wrapped with the provided passphrase
+func newMasterKey(agent *daemon.Client, s *backend.StorageContainer, passphrase string) (*crypto.MasterKey, error) {
+	mk, err := crypto.NewMasterKey()
+	if err != nil {
+		return nil, err
+	}
+
+	wrapped, err := mk.Wrap(passphrase)
+	if err != nil {
+		return nil, err
+	}
+
+	s.MasterKey = string(wrapped)
+	// caching is best effort
+	_ = agent.Store(masterKeyCacheName(s), string(mk.Bytes()))
+
+	return mk, nil
+}
+
+// unlockMasterKey returns the master key cached by the daemon, or prompts for the
+// store passphrase to unwrap it
+func unlockMasterKey(agent *daemon.Client, s *backend.StorageContainer) (*crypto.MasterKey, error) {
+	if mk := cachedMasterKey(agent, s); mk != nil {
+		return mk, nil
+	}
+
+	passphrase, err := dialogs.PasswordBox(storeDescription)
+	if err != nil {
+		return nil, err
+	}
+
+	mk, err := crypto.UnwrapMasterKey([]byte(s.MasterKey), passphrase)
+	if err != nil {
+		return nil, err
+	}
+	// caching is best effort
+	_ = agent.Store(masterKeyCacheName(s), string(mk.Bytes()))
+
+	return mk, nil
+}
+
+// cachedMasterKey returns the master key held by the daemon, if any
+func cachedMasterKey(agent *daemon.Client, s *backend.StorageContainer) *crypto.MasterKey {
+	// a daemon that isn't running is the same as an empty cache
+	cached, err := agent.Get(masterKeyCacheName(s))
+	if err != nil || cached == "" {
+		return nil
+	}
+
+	mk, err := crypto.MasterKeyFromBytes([]byte(cached))
+	if err != nil {
+		return nil
+	}
+
+	return mk
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+
+	"github.com/king-jam/git-credential-crypt-store/backend"
+)
+
+// migrateStore brings the store up to the current schema, the same as every
+// other command does on open, but shows what changes
+func migrateStore(storeLocation string, out io.Writer, args []string) error {
+	flags := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	dryRun := flags.Bool("dry-run", false, "Only show the migrations that would run.")
+
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	cs, err := backend.OpenUnmigrated(storeLocation)
+	if err != nil {
+		return err
+	}
+	// a backend without migrations is always at the current schema
+	var steps []backend.MigrationStep
+	if m, ok := cs.(backend.Migrator); ok {
+		steps, err = m.Migrate(*dryRun)
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(steps) == 0 {
+		_, err = fmt.Fprintf(out, "the store is at schema %d, nothing to do\n", backend.CurrentSchemaVersion)
+		return err
+	}
+
+	verb := "migrated"
+	if *dryRun {
+		verb = "would migrate"
+	}
+
+	for _, step := range steps {
+		if _, err := fmt.Fprintf(out, "%s %s\n", verb, step); err != nil {
+			return err
+		}
+	}
+
+	if *dryRun {
+		_, err = fmt.Fprintln(out, "the current contents would be kept as a backup")
+	}
+
+	return err
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+
+	"github.com/king-jam/git-credential-crypt-store/backend"
+	"github.com/king-jam/git-credential-crypt-store/crypto"
+	"github.com/king-jam/git-credential-crypt-store/daemon"
+	"github.com/king-jam/git-credential-crypt-store/dialogs"
+)
+
+// changePassphrase replaces the store passphrase. Entries that still have their
+// own passphrase and pass the filter are moved under the master key, they must
+// decrypt with the old passphrase. With rotate set a new master key is generated
+// and every master key entry is re-encrypted with it as well.
+// Everything is persisted at once, if any entry fails to decrypt nothing changes.
+func changePassphrase(db backend.CryptStoreInterface, agent *daemon.Client, args []string, rotate bool) error {
+	name := "passwd"
+	if rotate {
+		name = "rekey"
+	}
+
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	filter := addFilterFlags(flags)
+
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	s, err := db.GetStorageContainer()
+	if err != nil {
+		return err
+	}
+
+	oldPassphrase, err := dialogs.PasswordBox(storeDescription)
+	if err != nil {
+		return err
+	}
+
+	// check the old passphrase before asking for a new one
+	oldMK, err := unwrapIfSet(s.MasterKey, oldPassphrase)
+	if err != nil {
+		return err
+	}
+
+	newPassphrase, err := dialogs.PasswordCreationBox(storeDescription)
+	if err != nil {
+		return err
+	}
+
+	// another process may write in between, Update then runs this again on
+	// what it wrote
+	wrapped := s.MasterKey
+	var created, newMK *crypto.MasterKey
+	var cacheName string
+	err = backend.Update(db, func(s *backend.StorageContainer) (bool, error) {
+		// the old passphrase has to open a master key that changed meanwhile
+		if s.MasterKey != wrapped {
+			mk, err := unwrapIfSet(s.MasterKey, oldPassphrase)
+			if err != nil {
+				return false, fmt.Errorf("the store passphrase was changed meanwhile, nothing was changed: %w", err)
+			}
+
+			wrapped, oldMK = s.MasterKey, mk
+		}
+
+		newMK = oldMK
+		if rotate || newMK == nil {
+			if created == nil {
+				mk, err := crypto.NewMasterKey()
+				if err != nil {
+					return false, err
+				}
+
+				created = mk
+			}
+
+			newMK = created
+		}
+
+		updated, err := reencryptEntries(s.Entries, filter, oldPassphrase, oldMK, newMK)
+		if err != nil {
+			return false, err
+		}
+
+		rewrapped, err := newMK.Wrap(newPassphrase)
+		if err != nil {
+			return false, err
+		}
+
+		s.MasterKey = string(rewrapped)
+		s.Entries = updated
+		cacheName = masterKeyCacheName(s)
+		// a single AtomicPut, so either everything is re-encrypted or nothing is
+		return true, nil
+	})
+	if err != nil {
+		return err
+	}
+	// the old master key is cached under its old name, drop it
+	_ = agent.Forget()
+	_ = agent.Store(cacheName, string(newMK.Bytes()))
+
+	return nil
+}
+
+// unwrapIfSet unwraps the master key of a store, a store without one has none
+func unwrapIfSet(wrapped string, passphrase string) (*crypto.MasterKey, error) {
+	if wrapped == "" {
+		return nil, nil
+	}
+
+	return crypto.UnwrapMasterKey([]byte(wrapped), passphrase)
+}
+
+// reencryptEntries returns a copy of entries with the secrets moved from the old
+// passphrase or master key to newMK, entries is left as it is
+func reencryptEntries(entries []backend.Entry, filter *credentialFilter, oldPassphrase string, oldMK, newMK *crypto.MasterKey) ([]backend.Entry, error) {
+	updated := make([]backend.Entry, len(entries))
+	for idx, e := range entries {
+		updated[idx] = e
+
+		c := credentialFromEntry(e)
+		usesMasterKey, err := usesMasterKey(c)
+		if err != nil {
+			return nil, err
+		}
+		// master key entries only change when the master key does
+		if usesMasterKey && newMK == oldMK {
+			continue
+		}
+
+		if !usesMasterKey && !filter.matches(c) {
+			continue
+		}
+
+		decrypt := decryptWithPassphrase(oldPassphrase)
+		if usesMasterKey {
+			if oldMK == nil {
+				return nil, fmt.Errorf("%s is encrypted with a master key the store doesn't have, nothing was changed", c.Host)
+			}
+
+			decrypt = oldMK.Decrypt
+		}
+
+		if err := decryptSecrets(c, decrypt); err != nil {
+			return nil, fmt.Errorf("unable to decrypt %s for %s, nothing was changed: %s", c.Host, c.Username, err)
+		}
+
+		if err := transformSecrets(c, newMK.Encrypt); err != nil {
+			return nil, err
+		}
+
+		updated[idx] = storedEntry(c)
+	}
+
+	return updated, nil
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/king-jam/git-credential-crypt-store/backend"
+	"github.com/king-jam/git-credential-crypt-store/crypto"
+)
+
+func TestRekeyKeepsConcurrentWrites(t *testing.T) {
+	_, restore := usePrompter(testPassphrase)
+	defer restore()
+	agent, cleanup := noAgent(t)
+	defer cleanup()
+
+	db := backend.NewMemoryStore()
+	mustStore(t, db, agent, testCredential("example.com", "alice", "first"))
+
+	racing := &racingStore{CryptStoreInterface: db, race: func() {
+		mustStore(t, db, agent, testCredential("example.com", "bob", "second"))
+	}}
+	if err := changePassphrase(racing, agent, nil, true); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := db.GetStorageContainer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mk, err := crypto.UnwrapMasterKey([]byte(s.MasterKey), testPassphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]string{"alice": "first", "bob": "second"}
+	if len(s.Entries) != len(want) {
+		t.Fatalf("the store holds %d credentials, want %d", len(s.Entries), len(want))
+	}
+	for _, e := range s.Entries {
+		c := credentialFromEntry(e)
+		if err := decryptSecrets(c, mk.Decrypt); err != nil {
+			t.Fatalf("%s isn't encrypted with the new master key: %s", c.Username, err)
+		}
+		if c.Password != want[c.Username] {
+			t.Fatalf("%s decrypted to %q", c.Username, c.Password)
+		}
+	}
+}
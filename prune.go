@@ -0,0 +1,59 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/king-jam/git-credential-crypt-store/backend"
+)
+
+// pruneCredentials erases every stored credential whose password expired
+func pruneCredentials(db backend.CryptStoreInterface, out io.Writer, args []string) error {
+	flags := flag.NewFlagSet("prune", flag.ContinueOnError)
+	filter := addFilterFlags(flags)
+	dryRun := flags.Bool("dry-run", false, "Only show what would be erased.")
+
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	// another git process may write in between, Update then looks again
+	var pruned []*Credential
+	err := backend.Update(db, func(s *backend.StorageContainer) (bool, error) {
+		now := time.Now()
+		pruned = nil
+		var expired []int
+		for idx, e := range s.Entries {
+			c := credentialFromEntry(e)
+			if !filter.matches(c) || !c.Expired(now) {
+				continue
+			}
+
+			expired = append(expired, idx)
+			pruned = append(pruned, c)
+		}
+
+		if *dryRun || len(expired) == 0 {
+			return false, nil
+		}
+
+		s.Entries = removeIndexes(s.Entries, expired)
+		return true, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, c := range pruned {
+		// the path is stored without its leading slash
+		path := c.Path
+		if path != "" {
+			path = "/" + path
+		}
+		fmt.Fprintf(out, "%s://%s%s %s\n", c.Protocol, c.Host, path, c.Username)
+	}
+
+	return nil
+}
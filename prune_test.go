@@ -0,0 +1,47 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/king-jam/git-credential-crypt-store/backend"
+)
+
+func TestPruneKeepsConcurrentWrites(t *testing.T) {
+	_, restore := usePrompter(testPassphrase)
+	defer restore()
+	agent, cleanup := noAgent(t)
+	defer cleanup()
+
+	db := backend.NewMemoryStore()
+	s, err := db.GetStorageContainer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Entries = append(s.Entries, backend.Entry{
+		Protocol:          "https",
+		Host:              "example.com",
+		Username:          "alice",
+		Password:          "sealed",
+		PasswordExpiryUTC: "1",
+	})
+	if err := db.PersistStorageContainer(s); err != nil {
+		t.Fatal(err)
+	}
+
+	racing := &racingStore{CryptStoreInterface: db, race: func() {
+		mustStore(t, db, agent, testCredential("example.com", "bob", "secret"))
+	}}
+
+	var out bytes.Buffer
+	if err := pruneCredentials(racing, &out, nil); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != "https://example.com alice\n" {
+		t.Fatalf("prune printed %q", out.String())
+	}
+
+	if left := storedCredentials(t, db); len(left) != 1 || left[0].Username != "bob" {
+		t.Fatalf("prune left %d credentials, want the one stored meanwhile", len(left))
+	}
+}
@@ -2,56 +2,81 @@ package main
 
 import (
 	"fmt"
+	"time"
 
 	"github.com/king-jam/git-credential-crypt-store/backend"
-	"github.com/king-jam/git-credential-crypt-store/crypto"
-	"github.com/king-jam/git-credential-crypt-store/dialogs"
+	"github.com/king-jam/git-credential-crypt-store/daemon"
 )
 
-func storeCredentials(db backend.CryptStoreInterface, credentials *Credential) error {
+func storeCredentials(db backend.CryptStoreInterface, agent *daemon.Client, credentials *Credential) error {
 	// check that they are valid to store
 	if !credentials.IsValidToStore() {
 		return fmt.Errorf("Invalid Credential Storage Format")
 	}
-	s, err := db.GetStorageContainer()
-	if err != nil {
-		return err
+	// git asks us not to keep ephemeral credentials, e.g. short lived tokens
+	if credentials.Ephemeral {
+		return nil
+	}
+	// there is no point in keeping a token that already expired
+	if credentials.Expired(time.Now()) {
+		return nil
 	}
+	// another git process may write in between, Update then runs this again
+	keys := &masterKeySession{agent: agent}
+	return backend.Update(db, func(s *backend.StorageContainer) (bool, error) {
+		// work on a copy, the secrets are encrypted in place
+		c := *credentials
+		return addCredential(s, keys, &c)
+	})
+}
+
+// addCredential stores the credential in s, replacing the secret of a matching
+// one. It reports false when the same secret is stored already.
+func addCredential(s *backend.StorageContainer, keys *masterKeySession, credentials *Credential) (bool, error) {
 	// declare index to -1 for a later check
+	existing := -1
 	// iterate to see if we already have these credentials stored
-	for _, elem := range s.CredentialURLs {
-		c := new(Credential)
-		err := parseCredentialURL(elem, c)
-		if err != nil {
-			return err
-		}
-		if CredentialsMatch(credentials, c) {
-			return nil
+	for idx, e := range s.Entries {
+		c := credentialFromEntry(e)
+		if CredentialsMatch(credentials, c) && c.sameKind(credentials) {
+			unchanged, err := c.unchangedBy(credentials)
+			if err != nil {
+				return false, err
+			}
+			if unchanged {
+				return false, nil
+			}
+			// a rotated secret replaces the old one under the same identity
+			existing = idx
+			credentials.Protocol = c.Protocol
+			credentials.Host = c.Host
+			credentials.Path = c.Path
+			credentials.Username = c.Username
+			credentials.metadata = c.metadata
+			credentials.entryID = c.entryID
+			break
 		}
 	}
-	// if we don't have an entry, create it
-	password, err := dialogs.PasswordCreationBox(credentials.Username)
+	// encrypt under the store master key, the daemon may have it unlocked already
+	mk, err := keys.open(s)
 	if err != nil {
-		return err
+		return false, err
 	}
-	cipher, err := crypto.NewCipher(password)
-	if err != nil {
-		return err
+	if err := hashSecret(credentials); err != nil {
+		return false, err
 	}
-	ciphertext, err := cipher.Encrypt([]byte(credentials.Password))
-	if err != nil {
-		return err
+	if err := transformSecrets(credentials, mk.Encrypt); err != nil {
+		return false, err
 	}
-	credentials.Password = string(ciphertext)
-	credAsURL, err := credentials.ToURL()
-	if err != nil {
-		return err
+	now := time.Now()
+	if existing == -1 {
+		credentials.metadata.CreatedAt = now
 	}
-
-	s.CredentialURLs = append(s.CredentialURLs, credAsURL.String())
-	err = db.PersistStorageContainer(s)
-	if err != nil {
-		return err
+	credentials.metadata.UpdatedAt = now
+	if existing == -1 {
+		s.Entries = append(s.Entries, storedEntry(credentials))
+	} else {
+		s.Entries[existing] = storedEntry(credentials)
 	}
-	return nil
+	return true, nil
 }
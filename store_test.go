@@ -0,0 +1,74 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/king-jam/git-credential-crypt-store/backend"
+	"github.com/king-jam/git-credential-crypt-store/crypto"
+)
+
+func TestStoreUpdatesInPlace(t *testing.T) {
+	_, restore := usePrompter(testPassphrase)
+	defer restore()
+	agent, cleanup := noAgent(t)
+	defer cleanup()
+
+	dir, err := ioutil.TempDir("", "store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// bolt is the backend that gives entries an ID
+	db, err := backend.OpenBoltStore(filepath.Join(dir, "store.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mustStore(t, db, agent, testCredential("example.com", "alice", "old"))
+	mustStore(t, db, agent, testCredential("example.com", "bob", "other"))
+	before := storedUser(t, db, "alice", 2)
+	if before.entryID == 0 {
+		t.Fatal("the credential got no ID")
+	}
+
+	mustStore(t, db, agent, testCredential("example.com", "alice", "rotated"))
+	after := storedUser(t, db, "alice", 2)
+	if after.entryID != before.entryID {
+		t.Fatalf("the ID changed from %d to %d", before.entryID, after.entryID)
+	}
+	if !after.metadata.CreatedAt.Equal(before.metadata.CreatedAt) {
+		t.Fatal("the creation time changed")
+	}
+
+	same, err := crypto.VerifySecret([]byte(after.secretHash), []byte("rotated"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !same {
+		t.Fatal("the rotated secret wasn't stored")
+	}
+}
+
+// storedUser returns the stored credential of username after checking db holds
+// count credentials
+func storedUser(t *testing.T, db backend.CryptStoreInterface, username string, count int) *Credential {
+	t.Helper()
+
+	stored := storedCredentials(t, db)
+	if len(stored) != count {
+		t.Fatalf("the store holds %d credentials, want %d", len(stored), count)
+	}
+
+	for _, c := range stored {
+		if c.Username == username {
+			return c
+		}
+	}
+
+	t.Fatalf("%s isn't stored", username)
+	return nil
+}